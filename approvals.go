@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/slvwolf/ccentral/client"
+)
+
+// approvalTTL is how long change requests of protected keys wait for a review
+var approvalTTL = client.DefaultApprovalTTL
+
+type approvalsResponse struct {
+	Requests []client.ChangeRequest `json:"requests"`
+}
+
+// requiresApproval returns whether writing the keys needs the approval of a second user. Like the RBAC
+// policy, protected keys are only enforced while authentication is enabled as reviewers can not be told
+// apart otherwise.
+func requiresApproval(schema map[string]client.SchemaItem, keys []string) bool {
+	return auth.enabled() && len(client.ProtectedKeys(schema, keys)) > 0
+}
+
+// requestApproval stores the values as a change request instead of writing them, used when some of
+// the keys are protected
+func requestApproval(w http.ResponseWriter, r *http.Request, serviceID string, schema map[string]client.SchemaItem, values map[string]string) {
+	auditAction(r, "request-approval")
+	request, err := api(r).RequestChange(serviceID, values, requestActor(r), approvalTTL)
+	if err != nil {
+		writeInternalError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maskChangeRequest(schema, request)
+	output, err := json.Marshal(request)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+	w.Write(output)
+	log.Printf("Approval requested: [%v] %v by %v (id: %v)", serviceID, strings.Join(changeRequestKeys(request), ", "), requestActor(r), request.ID)
+}
+
+// handleApprovals lists the pending change requests of the service
+func handleApprovals(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if _, ok := authorize(w, r, serviceID, "", client.AccessRead); !ok {
+		return
+	}
+	requests, err := api(r).GetChangeRequests(serviceID)
+	if err != nil {
+		log.Printf("Problem getting change requests: %v", err)
+		writeInternalError(w, "Could not retrieve change requests", http.StatusInternalServerError)
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	for i := range requests {
+		maskChangeRequest(schema, &requests[i])
+	}
+	output, err := json.Marshal(approvalsResponse{Requests: requests})
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+// handleReview approves or rejects a change request, the reviewer must have write access to every key
+// of the request and can not be its author. Requires authentication as the actor header can be set by
+// anyone.
+func handleReview(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	vars := mux.Vars(r)
+	serviceID, requestID, action := vars["serviceId"], vars["requestId"], vars["action"]
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	if action != "approve" && action != "reject" {
+		writeInternalError(w, "Action must be approve or reject", http.StatusNotFound)
+		return
+	}
+	if !auth.enabled() {
+		writeInternalError(w, "Reviewing change requests requires authentication to be enabled", http.StatusForbidden)
+		return
+	}
+	auditAction(r, action)
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	requests, err := api(r).GetChangeRequests(serviceID)
+	if err != nil {
+		log.Printf("Problem getting change requests: %v", err)
+		writeInternalError(w, "Could not retrieve change requests", http.StatusInternalServerError)
+		return
+	}
+	var request *client.ChangeRequest
+	for i := range requests {
+		if requests[i].ID == requestID {
+			request = &requests[i]
+		}
+	}
+	if request == nil {
+		writeConfigError(w, client.ErrChangeRequestNotFound)
+		return
+	}
+	for keyID := range request.Values {
+		if !a.allowed(serviceID, keyID, client.AccessWrite) {
+			writeInternalError(w, "Access denied to "+keyID, http.StatusForbidden)
+			return
+		}
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	auditChanges(r, schema, configOf(request.Previous), request.Values)
+
+	_, version, err := api(r).ReviewChangeRequest(serviceID, requestID, requestActor(r), action == "approve")
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	if version == "" {
+		w.Write([]byte("{\"id\": \"" + requestID + "\"}"))
+		log.Printf("Change request rejected: [%v] %v by %v", serviceID, requestID, requestActor(r))
+		return
+	}
+	w.Header().Set("ETag", etagForVersion(version))
+	w.Write([]byte("{\"id\": \"" + requestID + "\", \"version\": \"" + version + "\"}"))
+	log.Printf("Change request approved: [%v] %v of %v by %v (version: %v)", serviceID, requestID, request.Actor, requestActor(r), version)
+}
+
+// requireAdminForProtected rejects writes of protected keys which can not go through an approval, like
+// rollbacks and scheduled changes, unless the user is an admin of the service. Checks every key of the
+// schema when keys is empty. Protected keys are not enforced while authentication is disabled, see
+// requiresApproval.
+func requireAdminForProtected(w http.ResponseWriter, a *access, serviceID string, schema map[string]client.SchemaItem, keys []string) bool {
+	if len(keys) == 0 {
+		for keyID := range schema {
+			keys = append(keys, keyID)
+		}
+	}
+	if !auth.enabled() {
+		return true
+	}
+	protected := client.ProtectedKeys(schema, keys)
+	if len(protected) > 0 && !a.allowed(serviceID, "*", client.AccessAdmin) {
+		writeInternalError(w, "Protected keys can only be changed through an approval: "+strings.Join(protected, ", "), http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// changeRequestKeys returns the keys of the change request in order
+func changeRequestKeys(request *client.ChangeRequest) []string {
+	keys := make([]string, 0, len(request.Values))
+	for keyID := range request.Values {
+		keys = append(keys, keyID)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// maskChangeRequest hides the values of password fields in the change request
+func maskChangeRequest(schema map[string]client.SchemaItem, request *client.ChangeRequest) {
+	for keyID, value := range request.Values {
+		request.Values[keyID] = maskValue(schema, keyID, value)
+	}
+	for keyID, value := range request.Previous {
+		request.Previous[keyID] = maskValue(schema, keyID, value)
+	}
+}
+
+// configOf returns the values as configuration items
+func configOf(values map[string]string) map[string]client.ConfigItem {
+	config := make(map[string]client.ConfigItem, len(values))
+	for keyID, value := range values {
+		config[keyID] = client.ConfigItem{Value: value}
+	}
+	return config
+}
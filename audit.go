@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/slvwolf/ccentral/client"
+)
+
+type auditContextKey struct{}
+
+// auditFile is the optional append-only JSON-lines copy of the audit log
+var auditFile struct {
+	sync.Mutex
+	file *os.File
+}
+
+func openAuditFile(path string) error {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	auditFile.file = f
+	return nil
+}
+
+// statusRecorder captures the status code written by a handler
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// audited records every mutating call of the handler into the audit log. Handlers can add the changed
+// values with auditValues or auditChanges and other details with auditDetail.
+func audited(action string, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet || r.Method == http.MethodHead {
+			h(w, r)
+			return
+		}
+		vars := mux.Vars(r)
+		record := &client.AuditRecord{
+			Timestamp: time.Now().Unix(),
+			Actor:     requestActor(r),
+			SourceIP:  sourceIP(r),
+			Action:    action,
+			Env:       vars["env"],
+			Service:   vars["serviceId"],
+			Key:       vars["keyId"],
+		}
+		recorder := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		h(recorder, r.WithContext(context.WithValue(r.Context(), auditContextKey{}, record)))
+		record.Status = recorder.status
+		record.Result = "success"
+		if recorder.status >= 400 {
+			record.Result = "failure"
+		}
+		writeAudit(*record)
+	}
+}
+
+// auditValues adds the old and the new value to the audit record of the request, password values are masked
+func auditValues(r *http.Request, schema map[string]client.SchemaItem, keyID string, oldValue string, newValue string) {
+	record, ok := r.Context().Value(auditContextKey{}).(*client.AuditRecord)
+	if !ok {
+		return
+	}
+	record.Key = keyID
+	record.OldValue = maskValue(schema, keyID, oldValue)
+	record.NewValue = maskValue(schema, keyID, newValue)
+}
+
+// auditDetail adds the keys and a description of a change which is not a configuration value to the
+// audit record of the request
+func auditDetail(r *http.Request, keyID string, detail string) {
+	record, ok := r.Context().Value(auditContextKey{}).(*client.AuditRecord)
+	if !ok {
+		return
+	}
+	record.Key = keyID
+	record.Detail = detail
+}
+
+// auditChanges adds the changed keys with their old and new values as JSON objects to the audit
+// record of the request, password values are masked
+func auditChanges(r *http.Request, schema map[string]client.SchemaItem, config map[string]client.ConfigItem, values map[string]string) {
+	record, ok := r.Context().Value(auditContextKey{}).(*client.AuditRecord)
+	if !ok {
+		return
+	}
+	keys := make([]string, 0, len(values))
+	oldValues := make(map[string]string, len(values))
+	newValues := make(map[string]string, len(values))
+	for keyID, value := range values {
+		keys = append(keys, keyID)
+		oldValues[keyID] = maskValue(schema, keyID, config[keyID].Value)
+		newValues[keyID] = maskValue(schema, keyID, value)
+	}
+	sort.Strings(keys)
+	oldData, _ := json.Marshal(oldValues)
+	newData, _ := json.Marshal(newValues)
+	record.Key = strings.Join(keys, ",")
+	record.OldValue = string(oldData)
+	record.NewValue = string(newData)
+}
+
+// auditAction overrides the action of the audit record, for handlers serving several actions
+func auditAction(r *http.Request, action string) {
+	if record, ok := r.Context().Value(auditContextKey{}).(*client.AuditRecord); ok {
+		record.Action = action
+	}
+}
+
+// maskValue hides values of password fields and their overrides
+func maskValue(schema map[string]client.SchemaItem, keyID string, value string) string {
+	if value != "" && schema[client.BaseKey(keyID)].Type == "password" {
+		return "******"
+	}
+	return value
+}
+
+// maskChanges hides the values of password fields in the changes
+func maskChanges(schema map[string]client.SchemaItem, changes []client.Change) {
+	for i, change := range changes {
+		changes[i].Old = maskValue(schema, change.Key, change.Old)
+		changes[i].New = maskValue(schema, change.Key, change.New)
+	}
+}
+
+func sourceIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+func writeAudit(record client.AuditRecord) {
+	err := cc.AddAuditRecord(record)
+	if err != nil {
+		log.Printf("Could not store audit record: %v", err)
+	}
+	auditFile.Lock()
+	defer auditFile.Unlock()
+	if auditFile.file == nil {
+		return
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		log.Printf("Could not convert audit record to json: %v", err)
+		return
+	}
+	_, err = auditFile.file.Write(append(data, '\n'))
+	if err != nil {
+		log.Printf("Could not write audit file: %v", err)
+	}
+}
+
+// parseTime accepts epoch seconds and RFC3339 timestamps
+func parseTime(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+func handleAudit(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	query := r.URL.Query()
+	filter := client.AuditFilter{Env: query.Get("env"), Service: query.Get("service"), Key: query.Get("key"), Actor: query.Get("actor")}
+	var err error
+	filter.From, err = parseTime(query.Get("from"))
+	if err != nil {
+		writeInternalError(w, "Parameter from must be epoch seconds or RFC3339", http.StatusBadRequest)
+		return
+	}
+	filter.To, err = parseTime(query.Get("to"))
+	if err != nil {
+		writeInternalError(w, "Parameter to must be epoch seconds or RFC3339", http.StatusBadRequest)
+		return
+	}
+	filter.Limit, err = strconv.Atoi(query.Get("limit"))
+	if err != nil || filter.Limit <= 0 {
+		filter.Limit = defaultHistoryLimit
+	}
+	access, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	// Records without a service, like policy changes, are only visible to admins of all services
+	filter.Visible = func(record client.AuditRecord) bool {
+		if record.Service == "" {
+			return access.allowed("*", "*", client.AccessAdmin)
+		}
+		return access.allowed(record.Service, "", client.AccessRead)
+	}
+	records, err := cc.GetAuditRecords(filter)
+	if err != nil {
+		log.Printf("Problem getting audit records: %v", err)
+		writeInternalError(w, "Could not retrieve audit records", http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(map[string][]client.AuditRecord{"audit": records})
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/subtle"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/bcrypt"
+)
+
+type userContextKey struct{}
+
+// authenticator identifies the user making the request
+type authenticator interface {
+	authenticate(r *http.Request) (string, bool)
+}
+
+// authConfig contains the enabled authenticators and the paths which do not require authentication
+type authConfig struct {
+	authenticators []authenticator
+	exempt         map[string]bool
+	basicRealm     bool
+}
+
+var auth = &authConfig{exempt: make(map[string]bool)}
+
+func (a *authConfig) enabled() bool {
+	return len(a.authenticators) > 0
+}
+
+// middleware rejects requests which could not be authenticated by any of the authenticators
+func (a *authConfig) middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !a.enabled() || a.exempt[r.URL.Path] {
+			next.ServeHTTP(w, r)
+			return
+		}
+		for _, authenticator := range a.authenticators {
+			if user, ok := authenticator.authenticate(r); ok {
+				next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), userContextKey{}, user)))
+				return
+			}
+		}
+		if a.basicRealm {
+			w.Header().Set("WWW-Authenticate", `Basic realm="CCentral"`)
+		} else {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="CCentral"`)
+		}
+		setHeaders(w)
+		writeInternalError(w, "Authentication required", http.StatusUnauthorized)
+	})
+}
+
+// authenticatedUser returns the user identified by the authentication middleware
+func authenticatedUser(r *http.Request) (string, bool) {
+	user, ok := r.Context().Value(userContextKey{}).(string)
+	return user, ok
+}
+
+// tokenAuth accepts static bearer tokens
+type tokenAuth struct {
+	tokens map[string]string
+}
+
+// newTokenAuth reads "USER TOKEN" lines from the file
+func newTokenAuth(path string) (*tokenAuth, error) {
+	a := &tokenAuth{tokens: make(map[string]string)}
+	err := readLines(path, func(line string) error {
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return errors.New("Expected USER TOKEN")
+		}
+		a.tokens[fields[1]] = fields[0]
+		return nil
+	})
+	return a, err
+}
+
+func (a *tokenAuth) authenticate(r *http.Request) (string, bool) {
+	header := r.Header.Get("Authorization")
+	if !strings.HasPrefix(header, "Bearer ") {
+		return "", false
+	}
+	given := []byte(strings.TrimPrefix(header, "Bearer "))
+	for token, user := range a.tokens {
+		if subtle.ConstantTimeCompare(given, []byte(token)) == 1 {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// htpasswdAuth accepts HTTP basic auth against bcrypt and {SHA} entries of an htpasswd file
+type htpasswdAuth struct {
+	users map[string]string
+}
+
+func newHtpasswdAuth(path string) (*htpasswdAuth, error) {
+	a := &htpasswdAuth{users: make(map[string]string)}
+	err := readLines(path, func(line string) error {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			return errors.New("Expected USER:HASH")
+		}
+		hash := parts[1]
+		if !strings.HasPrefix(hash, "$2") && !strings.HasPrefix(hash, "{SHA}") {
+			return errors.New("Only bcrypt and {SHA} hashes are supported")
+		}
+		a.users[parts[0]] = hash
+		return nil
+	})
+	return a, err
+}
+
+func (a *htpasswdAuth) authenticate(r *http.Request) (string, bool) {
+	user, password, ok := r.BasicAuth()
+	if !ok {
+		return "", false
+	}
+	hash, ok := a.users[user]
+	if !ok {
+		return "", false
+	}
+	if strings.HasPrefix(hash, "{SHA}") {
+		sum := sha1.Sum([]byte(password))
+		expected := "{SHA}" + base64.StdEncoding.EncodeToString(sum[:])
+		return user, subtle.ConstantTimeCompare([]byte(hash), []byte(expected)) == 1
+	}
+	return user, bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+// proxyAuth trusts the user header set by a reverse proxy connecting from one of the trusted networks
+type proxyAuth struct {
+	header  string
+	trusted []*net.IPNet
+}
+
+func newProxyAuth(header string, cidrs string) (*proxyAuth, error) {
+	a := &proxyAuth{header: header}
+	for _, cidr := range strings.Split(cidrs, ",") {
+		_, network, err := net.ParseCIDR(strings.TrimSpace(cidr))
+		if err != nil {
+			return nil, errors.Wrap(err, "Invalid trusted proxy network")
+		}
+		a.trusted = append(a.trusted, network)
+	}
+	return a, nil
+}
+
+func (a *proxyAuth) authenticate(r *http.Request) (string, bool) {
+	user := r.Header.Get(a.header)
+	if user == "" {
+		return "", false
+	}
+	ip := net.ParseIP(sourceIP(r))
+	for _, network := range a.trusted {
+		if ip != nil && network.Contains(ip) {
+			return user, true
+		}
+	}
+	return "", false
+}
+
+// readLines calls parse for every non-empty line which is not a comment
+func readLines(path string, parse func(line string) error) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		err = parse(line)
+		if err != nil {
+			return errors.Wrapf(err, "%v:%d", path, n)
+		}
+	}
+	return scanner.Err()
+}
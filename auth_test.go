@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func writeTempFile(t *testing.T, content string) string {
+	f, err := ioutil.TempFile("", "ccentral-auth")
+	assert.NoError(t, err)
+	f.WriteString(content)
+	f.Close()
+	return f.Name()
+}
+
+func TestTokenAuth(t *testing.T) {
+	path := writeTempFile(t, "# comment\nalice secret-token\n")
+	defer os.Remove(path)
+	a, err := newTokenAuth(path)
+	assert.NoError(t, err)
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("Authorization", "Bearer secret-token")
+	user, ok := a.authenticate(r)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+
+	r.Header.Set("Authorization", "Bearer wrong")
+	_, ok = a.authenticate(r)
+	assert.False(t, ok)
+}
+
+func TestHtpasswdAuth(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("password"), bcrypt.MinCost)
+	// {SHA} hash of "password"
+	path := writeTempFile(t, "alice:"+string(hash)+"\nbob:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n")
+	defer os.Remove(path)
+	a, err := newHtpasswdAuth(path)
+	assert.NoError(t, err)
+
+	for _, user := range []string{"alice", "bob"} {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.SetBasicAuth(user, "password")
+		authenticated, ok := a.authenticate(r)
+		assert.True(t, ok, user)
+		assert.Equal(t, user, authenticated)
+		r.SetBasicAuth(user, "wrong")
+		_, ok = a.authenticate(r)
+		assert.False(t, ok, user)
+	}
+}
+
+func TestHtpasswdAuthRejectsUnsupportedHashes(t *testing.T) {
+	path := writeTempFile(t, "alice:$apr1$salt$hash\n")
+	defer os.Remove(path)
+	_, err := newHtpasswdAuth(path)
+	assert.Error(t, err)
+}
+
+func TestProxyAuthRequiresTrustedNetwork(t *testing.T) {
+	a, err := newProxyAuth("X-Forwarded-User", "10.0.0.0/8")
+	assert.NoError(t, err)
+	r := httptest.NewRequest("GET", "/", nil)
+	r.Header.Set("X-Forwarded-User", "alice")
+	r.RemoteAddr = "10.1.2.3:1234"
+	user, ok := a.authenticate(r)
+	assert.True(t, ok)
+	assert.Equal(t, "alice", user)
+	r.RemoteAddr = "192.168.1.1:1234"
+	_, ok = a.authenticate(r)
+	assert.False(t, ok)
+}
+
+func TestMiddleware(t *testing.T) {
+	a := &authConfig{exempt: map[string]bool{"/check": true}}
+	a.authenticators = append(a.authenticators, &tokenAuth{tokens: map[string]string{"token": "alice"}})
+	handler := a.middleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, _ := authenticatedUser(r)
+		w.Write([]byte(user))
+	}))
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/api/1/services", nil))
+	assert.Equal(t, http.StatusUnauthorized, w.Code)
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/check", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+
+	w = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/1/services", nil)
+	r.Header.Set("Authorization", "Bearer token")
+	handler.ServeHTTP(w, r)
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "alice", w.Body.String())
+}
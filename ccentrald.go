@@ -1,6 +1,9 @@
 package main
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"flag"
 	"fmt"
@@ -8,14 +11,22 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
 	"github.com/slvwolf/ccentral/client"
+	"github.com/slvwolf/ccentral/plugins"
 	"github.com/slvwolf/ccentral/plugins/prometheus"
 	"github.com/slvwolf/ccentral/plugins/zabbix"
 )
 
+// defaultHistoryLimit is the page size of the history endpoint
+const defaultHistoryLimit = 50
+
 var cc client.CCApi
 var ccService *client.CCentralService
 
@@ -24,6 +35,18 @@ func writeInternalError(w http.ResponseWriter, msg string, status int) {
 	w.Write([]byte("{\"error\": \"" + msg + "\"}"))
 }
 
+func writeValidationError(w http.ResponseWriter, err *client.ValidationError) {
+	output, _ := json.Marshal(err)
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(output)
+}
+
+func writeValidationErrors(w http.ResponseWriter, errs []*client.ValidationError) {
+	output, _ := json.Marshal(map[string][]*client.ValidationError{"errors": errs})
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(output)
+}
+
 func setHeaders(w http.ResponseWriter) {
 	w.Header().Set("Content-type", "application/json")
 }
@@ -50,12 +73,25 @@ func handleRoot(w http.ResponseWriter, r *http.Request) {
 
 func handleServiceList(w http.ResponseWriter, r *http.Request) {
 	setHeaders(w)
-	serviceList, err := cc.GetServiceList()
+	serviceList, err := api(r).GetServiceList()
 	if err != nil {
 		w.WriteHeader(http.StatusInternalServerError)
 		w.Write([]byte("{\"error\": \"Could not retrieve configuration\"}"))
 		return
 	}
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	visible := serviceList.Services[:0]
+	for _, serviceID := range serviceList.Services {
+		if a.allowed(serviceID, "", client.AccessRead) {
+			visible = append(visible, serviceID)
+		}
+	}
+	serviceList.Services = visible
 	v, err := json.Marshal(serviceList)
 	if err != nil {
 		log.Printf(err.Error())
@@ -66,13 +102,88 @@ func handleServiceList(w http.ResponseWriter, r *http.Request) {
 	w.Write(v)
 }
 
+// etagForVersion returns the ETag representing the configuration version
+func etagForVersion(version string) string {
+	return "\"" + version + "\""
+}
+
+// versionFromETag returns the configuration version from an If-Match header, empty when any version matches
+func versionFromETag(etag string) string {
+	etag = strings.TrimPrefix(strings.TrimSpace(etag), "W/")
+	if etag == "*" {
+		return ""
+	}
+	return strings.Trim(etag, "\"")
+}
+
+// actorHeader can be used by the caller to tell who is making the change. It only labels the audit and
+// history records and is never used for authorization.
+const actorHeader = "X-CCentral-User"
+
+// requestActor returns the identity recorded as the author of changes made by the request. When
+// authentication is enabled the authenticated user is used and the header is ignored.
+func requestActor(r *http.Request) string {
+	if user, ok := authenticatedUser(r); ok {
+		return user
+	}
+	if auth.enabled() {
+		return "anonymous"
+	}
+	actor := r.Header.Get(actorHeader)
+	if actor == "" {
+		return "anonymous"
+	}
+	return actor
+}
+
+// writeOptions returns the conditions and the author of a configuration write
+func writeOptions(r *http.Request) client.WriteOptions {
+	return client.WriteOptions{IfVersion: versionFromETag(r.Header.Get("If-Match")), Actor: requestActor(r)}
+}
+
+// writeConfigError maps configuration write errors to HTTP statuses
+func writeConfigError(w http.ResponseWriter, err error) {
+	writeInternalError(w, err.Error(), configErrorStatus(err))
+}
+
+// configErrorStatus returns the HTTP status of a configuration write error
+func configErrorStatus(err error) int {
+	switch errors.Cause(err) {
+	case client.ErrVersionMismatch:
+		return http.StatusPreconditionFailed
+	case client.ErrConfigConflict:
+		return http.StatusConflict
+	case client.ErrInvalidVersion, client.ErrInvalidSchemaKey:
+		return http.StatusBadRequest
+	case client.ErrKeyNotSet, client.ErrServiceNotFound, client.ErrArchiveNotFound, client.ErrChangeRequestNotFound:
+		return http.StatusNotFound
+	case client.ErrServiceExists:
+		return http.StatusConflict
+	case client.ErrSelfApproval:
+		return http.StatusForbidden
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
 func handleItem(w http.ResponseWriter, r *http.Request) {
 	setHeaders(w)
 	vars := mux.Vars(r)
 	serviceID := vars["serviceId"]
 	keyID := vars["keyId"]
-	if r.Method != http.MethodPut {
-		writeInternalError(w, "Allowed methods are: PUT", http.StatusBadRequest)
+	switch r.Method {
+	case http.MethodPut:
+		setItem(w, r, serviceID, keyID)
+	case http.MethodDelete:
+		auditAction(r, "delete")
+		deleteItem(w, r, serviceID, keyID)
+	default:
+		writeInternalError(w, "Allowed methods are: PUT, DELETE", http.StatusBadRequest)
+	}
+}
+
+func setItem(w http.ResponseWriter, r *http.Request, serviceID string, keyID string) {
+	if _, ok := authorize(w, r, serviceID, keyID, client.AccessWrite); !ok {
 		return
 	}
 
@@ -82,14 +193,156 @@ func handleItem(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	version, err := cc.SetConfigItem(string(serviceID), string(keyID), string(value))
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	auditValues(r, schema, keyID, config[keyID].Value, string(value))
+	if errs := client.ValidateConfigValues(schema, map[string]string{keyID: string(value)}); errs != nil {
+		writeValidationError(w, errs[0])
+		return
+	}
+	if requiresApproval(schema, []string{keyID}) {
+		requestApproval(w, r, serviceID, schema, map[string]string{keyID: string(value)})
+		return
+	}
 
+	version, err := api(r).SetConfigItemWithOptions(string(serviceID), string(keyID), string(value), writeOptions(r))
 	if err != nil {
-		writeInternalError(w, err.Error(), http.StatusInternalServerError)
+		writeConfigError(w, err)
 		return
 	}
+	w.Header().Set("ETag", etagForVersion(version))
 
-	log.Printf("Configuration updated: [%v] %v=%v (version: %v)", string(serviceID), string(keyID), string(value), version)
+	log.Printf("Configuration updated: [%v] %v=%v by %v (version: %v)", serviceID, keyID, maskValue(schema, keyID, string(value)), requestActor(r), version)
+}
+
+// handleConfig changes several keys at once, the values are validated as a whole and written with a
+// single version increment
+func handleConfig(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if r.Method != http.MethodPatch {
+		writeInternalError(w, "Allowed methods are: PATCH", http.StatusBadRequest)
+		return
+	}
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, "Could not read body", http.StatusInternalServerError)
+		return
+	}
+	values := make(map[string]string)
+	err = json.Unmarshal(body, &values)
+	if err != nil {
+		writeInternalError(w, "Body must be a JSON object of key to string value", http.StatusBadRequest)
+		return
+	}
+	if len(values) == 0 {
+		writeInternalError(w, "No values given", http.StatusBadRequest)
+		return
+	}
+	for keyID := range values {
+		if !a.allowed(serviceID, keyID, client.AccessWrite) {
+			writeInternalError(w, "Access denied to "+keyID, http.StatusForbidden)
+			return
+		}
+	}
+
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	auditChanges(r, schema, config, values)
+	if errs := client.ValidateConfigValues(schema, values); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	// The whole update waits for approval so that it is still applied at once
+	keys := make([]string, 0, len(values))
+	for keyID := range values {
+		keys = append(keys, keyID)
+	}
+	if requiresApproval(schema, keys) {
+		requestApproval(w, r, serviceID, schema, values)
+		return
+	}
+
+	version, err := api(r).SetConfigItems(serviceID, values, writeOptions(r))
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etagForVersion(version))
+	w.Write([]byte("{\"version\": \"" + version + "\"}"))
+
+	changes := make([]string, 0, len(values))
+	for keyID, value := range values {
+		changes = append(changes, keyID+"="+maskValue(schema, keyID, value))
+	}
+	sort.Strings(changes)
+	log.Printf("Configuration updated: [%v] %v by %v (version: %v)", serviceID, strings.Join(changes, ", "), requestActor(r), version)
+}
+
+// deleteItem reverts the key to the schema default. With ?schema=true the key is removed from the
+// schema as well, which requires admin access.
+func deleteItem(w http.ResponseWriter, r *http.Request, serviceID string, keyID string) {
+	removeSchema, _ := strconv.ParseBool(r.URL.Query().Get("schema"))
+	level := client.AccessWrite
+	if removeSchema {
+		level = client.AccessAdmin
+	}
+	if _, ok := authorize(w, r, serviceID, keyID, level); !ok {
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	auditValues(r, schema, keyID, config[keyID].Value, "")
+	if !removeSchema && requiresApproval(schema, []string{keyID}) {
+		requestApproval(w, r, serviceID, schema, map[string]string{keyID: ""})
+		return
+	}
+	version := client.ConfigVersion(config)
+	if _, ok := config[keyID]; ok || !removeSchema {
+		version, err = api(r).DeleteConfigItem(serviceID, keyID, writeOptions(r))
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+	}
+	if removeSchema {
+		err = api(r).DeleteSchemaItem(serviceID, keyID)
+		if err != nil {
+			writeInternalError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+	}
+	w.Header().Set("ETag", etagForVersion(version))
+	w.Write([]byte("{\"version\": \"" + version + "\"}"))
+	log.Printf("Configuration deleted: [%v] %v by %v (version: %v, schema removed: %v)", serviceID, keyID, requestActor(r), version, removeSchema)
 }
 
 func hidePasswordFields(schema map[string]client.SchemaItem, config map[string]client.ConfigItem) {
@@ -102,36 +355,266 @@ func hidePasswordFields(schema map[string]client.SchemaItem, config map[string]c
 			config[k] = iv
 		}
 	}
+	for k, iv := range config {
+		if k != client.BaseKey(k) && schema[client.BaseKey(k)].Type == "password" {
+			iv.Value = "******"
+			config[k] = iv
+		}
+	}
+}
+
+type historyResponse struct {
+	History []client.HistoryItem `json:"history"`
+	Next    int                  `json:"next,omitempty"`
+}
+
+func handleHistory(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	before, _ := strconv.Atoi(r.URL.Query().Get("before"))
+	limit, err := strconv.Atoi(r.URL.Query().Get("limit"))
+	if err != nil || limit <= 0 {
+		limit = defaultHistoryLimit
+	}
+	if _, ok := authorize(w, r, serviceID, "", client.AccessRead); !ok {
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	history, err := api(r).GetHistory(serviceID, before, limit)
+	if err != nil {
+		log.Printf("Problem getting history: %v", err)
+		writeInternalError(w, "Could not retrieve history", http.StatusInternalServerError)
+		return
+	}
+	response := historyResponse{History: history}
+	for i, item := range history {
+		if schema[client.BaseKey(item.Key)].Type == "password" {
+			history[i].OldValue = "******"
+			history[i].NewValue = "******"
+		}
+	}
+	if len(history) >= limit {
+		response.Next = history[len(history)-1].Version
+	}
+	output, err := json.Marshal(response)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func handleRollback(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	target, err := strconv.Atoi(r.URL.Query().Get("version"))
+	if err != nil {
+		writeInternalError(w, "Parameter version must be an integer", http.StatusBadRequest)
+		return
+	}
+	// Rollback may touch any key so write access must not be limited to some keys
+	a, ok := authorize(w, r, serviceID, "*", client.AccessWrite)
+	if !ok {
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	if !requireAdminForProtected(w, a, serviceID, schema, nil) {
+		return
+	}
+	auditDetail(r, "", "version "+strconv.Itoa(target))
+	version, err := api(r).RollbackConfig(serviceID, target, writeOptions(r))
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	w.Header().Set("ETag", etagForVersion(version))
+	w.Write([]byte("{\"version\": \"" + version + "\"}"))
+	log.Printf("Configuration rolled back: [%v] to version %v by %v (version: %v)", serviceID, target, requestActor(r), version)
+}
+
+// serviceResponse adds the keys the user is allowed to change, the effective values of every instance
+// and the number of instances each feature flag is on for to the service
+type serviceResponse struct {
+	*client.Service
+	Writable  map[string]bool                             `json:"writable"`
+	Effective map[string]map[string]client.EffectiveValue `json:"effective"`
+	Flags     map[string]int                              `json:"flags"`
 }
 
 func handleService(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	setHeaders(w)
 	serviceID := vars["serviceId"]
-	schema, err := cc.GetSchema(serviceID)
+	switch r.Method {
+	case http.MethodGet:
+		getService(w, r, serviceID)
+	case http.MethodDelete:
+		deleteService(w, r, serviceID)
+	default:
+		writeInternalError(w, "Allowed methods are: GET, DELETE", http.StatusBadRequest)
+	}
+}
+
+func getService(w http.ResponseWriter, r *http.Request, serviceID string) {
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
 	if err != nil {
 		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
 		return
 	}
-	config, err := cc.GetConfig(serviceID)
+	config, err := api(r).GetConfig(serviceID)
 	if err != nil {
 		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
 		return
 	}
-	instances, err := cc.GetInstanceList(serviceID)
+	instances, err := api(r).GetInstanceList(serviceID)
 	if err != nil {
 		log.Printf("Problem getting instances: %v", err)
 		writeInternalError(w, "Could not retrieve instances", http.StatusInternalServerError)
 		return
 	}
-	info, err := cc.GetServiceInfoList(serviceID)
+	info, err := api(r).GetServiceInfoList(serviceID)
 	if err != nil {
 		log.Printf("Problem getting service info: %v", err)
 		writeInternalError(w, "Could not retrieve service info", http.StatusInternalServerError)
 		return
 	}
+	version := client.ConfigVersion(config)
 	hidePasswordFields(schema, config)
-	output, err := json.Marshal(client.NewService(schema, config, instances, info))
+	response := serviceResponse{
+		Service:   client.NewService(schema, config, instances, info),
+		Writable:  make(map[string]bool, len(schema)),
+		Effective: make(map[string]map[string]client.EffectiveValue, len(instances)),
+		Flags:     make(map[string]int),
+	}
+	for keyID := range schema {
+		response.Writable[keyID] = a.allowed(serviceID, keyID, client.AccessWrite)
+	}
+	for clientID, data := range instances {
+		response.Effective[clientID] = client.ResolveAll(schema, config, client.TargetFromInstance(clientID, data))
+	}
+	for keyID, item := range schema {
+		if item.Type != client.TypeFlag {
+			continue
+		}
+		response.Flags[keyID] = 0
+		for clientID, values := range response.Effective {
+			if instances[clientID][client.InstanceStatusKey] == client.InstanceDead {
+				continue
+			}
+			flag, err := client.ParseFlag(values[keyID].Value)
+			if err == nil && flag.Enabled(keyID, clientID) {
+				response.Flags[keyID]++
+			}
+		}
+	}
+	output, err := json.Marshal(response)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("ETag", etagForVersion(version))
+	w.Write(output)
+}
+
+// deleteToken returns the token confirming the deletion of the service at the configuration version
+func deleteToken(serviceID string, version string) string {
+	sum := sha256.Sum256([]byte(serviceID + "@" + version))
+	return hex.EncodeToString(sum[:6])
+}
+
+// deleteService archives the service. The first request without ?confirm= responds with the token
+// which has to be passed back, the token changes whenever the configuration changes.
+func deleteService(w http.ResponseWriter, r *http.Request, serviceID string) {
+	if _, ok := authorize(w, r, serviceID, "*", client.AccessAdmin); !ok {
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	token := deleteToken(serviceID, client.ConfigVersion(config))
+	if r.URL.Query().Get("confirm") != token {
+		w.WriteHeader(http.StatusPreconditionRequired)
+		w.Write([]byte("{\"error\": \"Repeat the request with ?confirm=" + token + " to delete the service\", \"confirm\": \"" + token + "\"}"))
+		return
+	}
+	archive, err := api(r).ArchiveService(serviceID, requestActor(r))
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	output, err := json.Marshal(archive)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+	log.Printf("Service archived: [%v] by %v (archive: %v)", serviceID, requestActor(r), archive.ID)
+}
+
+// handleStaleKeys lists configuration values which no longer have a schema entry
+func handleStaleKeys(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if _, ok := authorize(w, r, serviceID, "", client.AccessRead); !ok {
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(map[string]map[string]client.ConfigItem{"stale": client.StaleKeys(schema, config)})
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func handleArchive(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	archives, err := api(r).GetArchivedServices()
+	if err != nil {
+		log.Printf("Problem getting archived services: %v", err)
+		writeInternalError(w, "Could not retrieve archived services", http.StatusInternalServerError)
+		return
+	}
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	visible := archives[:0]
+	for _, archive := range archives {
+		if a.allowed(archive.Service, "", client.AccessRead) {
+			visible = append(visible, archive)
+		}
+	}
+	output, err := json.Marshal(map[string][]client.ArchivedService{"archive": visible})
 	if err != nil {
 		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
 		return
@@ -139,6 +622,25 @@ func handleService(w http.ResponseWriter, r *http.Request) {
 	w.Write(output)
 }
 
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	vars := mux.Vars(r)
+	serviceID := vars["serviceId"]
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	if _, ok := authorize(w, r, serviceID, "*", client.AccessAdmin); !ok {
+		return
+	}
+	err := api(r).RestoreService(serviceID, vars["archiveId"])
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	log.Printf("Service restored: [%v] from archive %v by %v", serviceID, vars["archiveId"], requestActor(r))
+}
+
 func handlePrometheus(w http.ResponseWriter, r *http.Request) {
 	enabled, _ := ccService.GetConfigBool("prometheus_enabled")
 	if enabled {
@@ -157,10 +659,129 @@ func handleCheck(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintf(w, "OK")
 }
 
+func envDefault(name string, defaultValue string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func envBool(name string, defaultValue bool) bool {
+	value, err := strconv.ParseBool(os.Getenv(name))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// configureAuth enables the authenticators which have been configured
+func configureAuth(tokens string, htpasswd string, proxyHeader string, proxyCIDRs string) error {
+	if tokens != "" {
+		a, err := newTokenAuth(tokens)
+		if err != nil {
+			return err
+		}
+		auth.authenticators = append(auth.authenticators, a)
+		log.Printf("Bearer token authentication enabled (%d tokens)", len(a.tokens))
+	}
+	if htpasswd != "" {
+		a, err := newHtpasswdAuth(htpasswd)
+		if err != nil {
+			return err
+		}
+		auth.authenticators = append(auth.authenticators, a)
+		auth.basicRealm = true
+		log.Printf("Basic authentication enabled (%d users)", len(a.users))
+	}
+	if proxyHeader != "" {
+		a, err := newProxyAuth(proxyHeader, proxyCIDRs)
+		if err != nil {
+			return err
+		}
+		auth.authenticators = append(auth.authenticators, a)
+		log.Printf("Reverse proxy authentication enabled (header %v from %v)", proxyHeader, proxyCIDRs)
+	}
+	return nil
+}
+
+// loadKeyring reads the keyring from the file or, when no file is given, from the KEYRING variable.
+// Returns nil when neither has been set.
+func loadKeyring(path string) (*client.Keyring, error) {
+	if path != "" {
+		return client.LoadKeyring(path)
+	}
+	if keys := os.Getenv("KEYRING"); keys != "" {
+		return client.ParseKeyring(keys)
+	}
+	return nil, nil
+}
+
+func runRotateSecrets(etcdHost string, keyring *client.Keyring) {
+	if keyring == nil {
+		log.Fatal("Keyring is required for rotating secrets, use -keyring-file or KEYRING")
+	}
+	service := &client.CCService{}
+	err := service.InitCCentral(etcdHost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	service.SetKeyring(keyring)
+	count, err := service.RotateSecrets()
+	if err != nil {
+		log.Fatalf("Rotation failed after %d values: %v", count, err)
+	}
+	log.Printf("Re-encrypted %d values", count)
+}
+
+// instanceGCInterval is the interval of checking for dead instances to remove
+const instanceGCInterval = 10 * time.Minute
+
+// removeDeadInstances removes instances which have not reported for maxAge every instanceGCInterval
+func removeDeadInstances(service *client.CCService, maxAge time.Duration) {
+	for {
+		count, err := service.RemoveDeadInstances(maxAge)
+		if err != nil {
+			log.Printf("Could not remove dead instances: %v", err)
+		}
+		if count > 0 {
+			log.Printf("Removed %d dead instances", count)
+		}
+		time.Sleep(instanceGCInterval)
+	}
+}
+
+func runMigration(etcdHost string, v2Host string) {
+	service := &client.CCService{}
+	err := service.InitCCentral(etcdHost)
+	if err != nil {
+		log.Fatal(err)
+	}
+	count, err := service.MigrateFromV2(v2Host)
+	if err != nil {
+		log.Fatalf("Migration failed after %d keys: %v", count, err)
+	}
+	log.Printf("Migrated %d keys from %v to %v", count, v2Host, etcdHost)
+}
+
 func main() {
 	etcdHost := flag.String("etcd", os.Getenv("ETCD"), "etcd locations and port (Default: http://127.0.0.1:2379)")
 	port := flag.String("port", os.Getenv("PORT"), "Port to listen (Default: 3000)")
 	presentation := flag.Bool("presentation", false, "Run in presentation mode")
+	auditPath := flag.String("audit-file", os.Getenv("AUDIT_FILE"), "Append audit records as JSON lines to the file (Default: disabled)")
+	authTokens := flag.String("auth-tokens", os.Getenv("AUTH_TOKENS"), "File of \"USER TOKEN\" lines accepted as bearer tokens")
+	authHtpasswd := flag.String("auth-htpasswd", os.Getenv("AUTH_HTPASSWD"), "htpasswd file (bcrypt or SHA) for HTTP basic auth")
+	authProxyHeader := flag.String("auth-proxy-header", os.Getenv("AUTH_PROXY_HEADER"), "Header containing the user set by a trusted reverse proxy")
+	authProxyCIDRs := flag.String("auth-proxy-cidrs", envDefault("AUTH_PROXY_CIDRS", "127.0.0.1/32,::1/128"), "Networks trusted to set the proxy header")
+	authExemptCheck := flag.Bool("auth-exempt-check", envBool("AUTH_EXEMPT_CHECK", true), "Allow /check without authentication")
+	authExemptPrometheus := flag.Bool("auth-exempt-prometheus", envBool("AUTH_EXEMPT_PROMETHEUS", false), "Allow /plugins/prometheus/data without authentication")
+	migrateV2 := flag.String("migrate-v2", "", "Copy the CCentral tree from the given etcd v2 location into etcd v3 and exit")
+	keyringPath := flag.String("keyring-file", os.Getenv("KEYRING_FILE"), "File of \"KEY_ID BASE64_KEY\" lines used to encrypt password values, first key is primary")
+	rotateSecrets := flag.Bool("rotate-secrets", false, "Re-encrypt all password values with the primary key and exit")
+	scheduler := flag.Bool("scheduler", envBool("SCHEDULER", true), "Apply scheduled configuration changes, one of the running replicas is elected to do it")
+	schedulerInterval := flag.Duration("scheduler-interval", 10*time.Second, "Interval of checking for due scheduled changes")
+	flag.BoolVar(&plugins.IncludeDeadInstances, "metrics-include-dead", envBool("METRICS_INCLUDE_DEAD", false), "Include instances which have stopped reporting in the Prometheus and Zabbix metrics")
+	instanceGC := flag.Duration("instance-gc", 0, "Remove instances which have not reported for the duration, such as 24h (Default: disabled)")
+	flag.DurationVar(&approvalTTL, "approval-ttl", client.DefaultApprovalTTL, "Time change requests of protected keys wait for approval before they expire")
 
 	flag.Parse()
 	if *etcdHost == "" {
@@ -170,6 +791,20 @@ func main() {
 		*port = "3000"
 	}
 
+	if *migrateV2 != "" {
+		runMigration(*etcdHost, *migrateV2)
+		return
+	}
+
+	keyring, err := loadKeyring(*keyringPath)
+	if err != nil {
+		log.Fatalf("Could not load keyring: %v", err)
+	}
+	if *rotateSecrets {
+		runRotateSecrets(*etcdHost, keyring)
+		return
+	}
+
 	log.Printf(`
 _________ _________                __                .__
 \_   ___ \\_   ___ \  ____   _____/  |_____________  |  |
@@ -178,37 +813,100 @@ _________ _________                __                .__
  \______  /\______  /\___  >___|  /__|  |__|  (____  /____/
         \/        \/     \/     \/                 \/      `)
 
+	if *auditPath != "" {
+		err := openAuditFile(*auditPath)
+		if err != nil {
+			log.Fatalf("Could not open audit file: %v", err)
+		}
+	}
+
+	err = configureAuth(*authTokens, *authHtpasswd, *authProxyHeader, *authProxyCIDRs)
+	if err != nil {
+		log.Fatalf("Could not configure authentication: %v", err)
+	}
+	auth.exempt["/check"] = *authExemptCheck
+	auth.exempt["/plugins/prometheus/data"] = *authExemptPrometheus
+
 	router := mux.NewRouter().StrictSlash(true)
+	router.Use(auth.middleware)
+	router.Use(envMiddleware)
 	router.HandleFunc("/", handleRoot)
 	router.HandleFunc("/{res}", handleRoot)
 	router.HandleFunc("/check", handleCheck)
 	router.HandleFunc("/{path}/{res}", handleRoot)
-	cc = &client.CCService{}
+	service := &client.CCService{}
+	cc = service
 	if !*presentation {
 		err := cc.InitCCentral(*etcdHost)
 		if err != nil {
 			panic("Could not initialize CCentral")
 		}
+		if keyring != nil {
+			service.SetKeyring(keyring)
+			log.Printf("Password values are encrypted at rest")
+		}
+		if policy, err := cc.GetPolicy(); err == nil && policy != nil && !auth.enabled() {
+			log.Printf("WARNING: Authentication is disabled, the stored RBAC policy is not enforced")
+		}
 		ccService = client.InitCCentralService(cc, "ccentral")
+		ccService.SetKeyring(keyring)
 		ccService.AddSchema("zabbix_enabled", "0", "boolean", "Zabbix Enabled", "Boolean for enabling or disabling Zabbix monitoring for all services")
 		ccService.AddSchema("zabbix_host", "localhost", "string", "Zabbix Hostname", "Hostname for Zabbix")
-		ccService.AddSchema("zabbix_port", "10051", "integer", "Zabbix Port", "Port for Zabbix")
-		ccService.AddSchema("zabbix_interval", "60", "integer", "Zabbix Interval", "Update interval for Zabbix metrics")
+		ccService.AddSchemaWithOptions("zabbix_port", "10051", "integer", "Zabbix Port", "Port for Zabbix", client.WithMin(1), client.WithMax(65535))
+		ccService.AddSchemaWithOptions("zabbix_interval", "60", "integer", "Zabbix Interval", "Update interval for Zabbix metrics", client.WithMin(1))
 		ccService.AddSchema("prometheus_enabled", "0", "boolean", "Prometheus Enabled", "Boolean for enabling or disabling prometheus endpoint (/plugins/prometheus/data)")
-		router.HandleFunc("/api/1/services", handleServiceList)
-		router.HandleFunc("/api/1/services/{serviceId}", handleService)
-		router.HandleFunc("/api/1/services/{serviceId}/keys/{keyId}", handleItem)
+		err = ccService.StartWatch()
+		if err != nil {
+			log.Printf("Could not watch CCentral configuration, falling back to polling: %v", err)
+		}
+		err = ccService.StartReporting(time.Minute)
+		if err != nil {
+			log.Printf("Could not start instance reporting: %v", err)
+		}
+		// Routes without an environment use the default environment
+		for _, prefix := range []string{"/api/1", "/api/1/envs/{env}"} {
+			router.HandleFunc(prefix+"/services", handleServiceList)
+			router.HandleFunc(prefix+"/services/{serviceId}", audited("archive", handleService))
+			router.HandleFunc(prefix+"/services/{serviceId}/keys/{keyId}", audited("set", handleItem))
+			router.HandleFunc(prefix+"/services/{serviceId}/config", audited("update", handleConfig))
+			router.HandleFunc(prefix+"/services/{serviceId}/stale", handleStaleKeys)
+			router.HandleFunc(prefix+"/services/{serviceId}/export", handleServiceExport)
+			router.HandleFunc(prefix+"/services/{serviceId}/import", audited("import", handleServiceImport))
+			router.HandleFunc(prefix+"/services/{serviceId}/promote", audited("promote", handlePromote))
+			router.HandleFunc(prefix+"/services/{serviceId}/schedule", audited("schedule", handleSchedule))
+			router.HandleFunc(prefix+"/services/{serviceId}/schedule/{changeId}", audited("cancel-schedule", handleScheduledChange))
+			router.HandleFunc(prefix+"/services/{serviceId}/approvals", handleApprovals)
+			router.HandleFunc(prefix+"/services/{serviceId}/approvals/{requestId}/{action}", audited("approve", handleReview))
+			router.HandleFunc(prefix+"/export", handleExport)
+			router.HandleFunc(prefix+"/diff", handleDiff)
+			router.HandleFunc(prefix+"/import", audited("import", handleImport))
+			router.HandleFunc(prefix+"/services/{serviceId}/history", handleHistory)
+			router.HandleFunc(prefix+"/services/{serviceId}/rollback", audited("rollback", handleRollback))
+			router.HandleFunc(prefix+"/archive", handleArchive)
+			router.HandleFunc(prefix+"/archive/{serviceId}/{archiveId}", audited("restore", handleRestore))
+		}
+		router.HandleFunc("/api/1/envs", handleEnvs)
+		router.HandleFunc("/api/1/audit", handleAudit)
+		router.HandleFunc("/api/1/rbac", audited("rbac", handlePolicy))
 		router.HandleFunc("/plugins/prometheus/data", handlePrometheus)
 		zabbix.StartZabbixUpdater(ccService, cc)
+		if *instanceGC > 0 {
+			go removeDeadInstances(service, *instanceGC)
+		}
+		if *scheduler {
+			go service.RunScheduler(context.Background(), *schedulerInterval, notifyScheduledChange)
+		}
 	} else {
 		// TODO: User mocked CCApi instead
 		log.Printf("Running in PRESENTATION mode")
-		router.HandleFunc("/api/1/services", handleMockServiceList)
-		router.HandleFunc("/api/1/services/{serviceId}", handleMockService)
-		router.HandleFunc("/api/1/services/{serviceId}/keys/{keyId}", handleMockItem)
+		for _, prefix := range []string{"/api/1", "/api/1/envs/{env}"} {
+			router.HandleFunc(prefix+"/services", handleMockServiceList)
+			router.HandleFunc(prefix+"/services/{serviceId}", handleMockService)
+			router.HandleFunc(prefix+"/services/{serviceId}/keys/{keyId}", handleMockItem)
+		}
 	}
 	log.Printf("Admin UI available at :" + *port)
-	err := http.ListenAndServe(":"+*port, router)
+	err = http.ListenAndServe(":"+*port, router)
 	if err != nil {
 		log.Fatal(err)
 	}
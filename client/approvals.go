@@ -0,0 +1,198 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// approvalsPrefix contains the pending change requests of every environment
+const approvalsPrefix = "/ccentral/approvals/"
+
+// DefaultApprovalTTL is how long change requests wait for a review before they expire
+const DefaultApprovalTTL = 24 * time.Hour
+
+// ErrSelfApproval is returned when the author of a change request tries to review it
+var ErrSelfApproval = errors.New("Change request must be reviewed by another user")
+
+// ErrChangeRequestNotFound is returned for change requests which have expired or been reviewed already
+var ErrChangeRequestNotFound = errors.New("Change request not found, it may have expired or been reviewed")
+
+// ChangeRequest is a pending change to protected keys waiting for the approval of a second user. Empty
+// values revert the key to the schema default. Password values are stored encrypted when a keyring
+// has been set.
+type ChangeRequest struct {
+	ID      string            `json:"id"`
+	Env     string            `json:"env"`
+	Service string            `json:"service"`
+	Values  map[string]string `json:"values"`
+	// Previous contains the values at the time of the request, empty when the key was not set
+	Previous map[string]string `json:"previous"`
+	// Version is the configuration version the request was made against
+	Version string `json:"version"`
+	Actor   string `json:"actor"`
+	Created int64  `json:"created"`
+	Expires int64  `json:"expires"`
+}
+
+func changeRequestKey(requestID string) string {
+	return approvalsPrefix + requestID
+}
+
+// ProtectedKeys returns the keys (or overrides of keys) which have been declared protected in the schema
+func ProtectedKeys(schema map[string]SchemaItem, keys []string) []string {
+	var protected []string
+	for _, keyID := range keys {
+		if item, ok := SchemaItemFor(schema, keyID); ok && item.Protected {
+			protected = append(protected, keyID)
+		}
+	}
+	sort.Strings(protected)
+	return protected
+}
+
+// RequestChange stores a change request for the values of the service. The request expires unless
+// it is reviewed within ttl, see ReviewChangeRequest.
+func (cc *CCService) RequestChange(serviceID string, values map[string]string, actor string, ttl time.Duration) (*ChangeRequest, error) {
+	if len(values) == 0 {
+		return nil, errors.New("No values given")
+	}
+	if ttl < time.Second {
+		return nil, errors.New("Change request must be valid at least one second")
+	}
+	values, err := cc.encryptValues(serviceID, values)
+	if err != nil {
+		return nil, err
+	}
+	config, err := cc.GetConfig(serviceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not retrieve service configuration")
+	}
+	now := time.Now()
+	request := ChangeRequest{
+		ID:       newClientID(),
+		Env:      cc.EnvName(),
+		Service:  serviceID,
+		Values:   values,
+		Previous: make(map[string]string, len(values)),
+		Version:  ConfigVersion(config),
+		Actor:    actor,
+		Created:  now.Unix(),
+		Expires:  now.Add(ttl).Unix(),
+	}
+	for keyID := range values {
+		request.Previous[keyID] = config[keyID].Value
+	}
+	data, err := json.Marshal(request)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not convert to JSON")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	// Expired requests are removed by etcd with the lease
+	lease, err := cc.etcd.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create lease for change request")
+	}
+	_, err = cc.etcd.Put(ctx, changeRequestKey(request.ID), string(data), clientv3.WithLease(lease.ID))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not store change request")
+	}
+	return &request, nil
+}
+
+// GetChangeRequests returns the pending change requests of the service, oldest first
+func (cc *CCService) GetChangeRequests(serviceID string) ([]ChangeRequest, error) {
+	resp, err := cc.getPrefix(approvalsPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get change requests")
+	}
+	requests := make([]ChangeRequest, 0)
+	for _, kv := range resp.Kvs {
+		request := ChangeRequest{}
+		err = json.Unmarshal(kv.Value, &request)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not unmarshal change request "+string(kv.Key))
+		}
+		if request.Env == cc.EnvName() && request.Service == serviceID {
+			requests = append(requests, request)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].Created < requests[j].Created })
+	return requests, nil
+}
+
+// ReviewChangeRequest approves or rejects the change request, approved values are written with a single
+// version increment and the request is removed in the same transaction. The author of the request can
+// not review it. Requests of keys which have been changed since the request was made are not approved,
+// ErrConfigConflict is returned instead. Returns the request and the new configuration version when
+// approved.
+func (cc *CCService) ReviewChangeRequest(serviceID string, requestID string, reviewer string, approve bool) (*ChangeRequest, string, error) {
+	key := changeRequestKey(requestID)
+	resp, err := cc.getKey(key)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "Could not get change request")
+	}
+	request := ChangeRequest{}
+	if len(resp.Kvs) == 0 || json.Unmarshal(resp.Kvs[0].Value, &request) != nil ||
+		request.Env != cc.EnvName() || request.Service != serviceID {
+		return nil, "", ErrChangeRequestNotFound
+	}
+	if reviewer == request.Actor {
+		return nil, "", ErrSelfApproval
+	}
+	revision := resp.Kvs[0].ModRevision
+	// Comparing the revision keeps concurrent reviews from applying the request twice
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", revision)}
+	ops := []clientv3.Op{clientv3.OpDelete(key)}
+	if !approve {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		defer cancel()
+		txn, err := cc.etcd.Txn(ctx).If(cmps...).Then(ops...).Commit()
+		if err != nil {
+			return nil, "", errors.Wrap(err, "Could not review change request")
+		}
+		if !txn.Succeeded {
+			return nil, "", ErrChangeRequestNotFound
+		}
+		return &request, "", nil
+	}
+	values, err := cc.encryptValues(serviceID, request.Values)
+	if err != nil {
+		return nil, "", err
+	}
+	version, err := cc.updateConfigTxn(serviceID, WriteOptions{Actor: request.Actor + " (approved by " + reviewer + ")"}, func(config map[string]ConfigItem) error {
+		// A reviewed or expired request would fail the transaction on every retry
+		resp, err := cc.getKey(key)
+		if err != nil {
+			return errors.Wrap(err, "Could not get change request")
+		}
+		if len(resp.Kvs) == 0 || resp.Kvs[0].ModRevision != revision {
+			return ErrChangeRequestNotFound
+		}
+		for keyID := range values {
+			if cc.decryptValue(config[keyID].Value) != cc.decryptValue(request.Previous[keyID]) {
+				return errors.Wrap(ErrConfigConflict, keyID+" was changed after the change was requested")
+			}
+		}
+		now := time.Now().Unix()
+		for keyID, value := range values {
+			if value == "" {
+				delete(config, keyID)
+			} else {
+				config[keyID] = ConfigItem{Value: value, Changed: now}
+			}
+		}
+		return nil
+	}, func(version string) ([]clientv3.Cmp, []clientv3.Op, error) {
+		return cmps, ops, nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	return &request, version, nil
+}
@@ -0,0 +1,116 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+const auditPrefix = "/ccentral/audit/"
+
+// auditPageSize is the number of audit records read with a single request
+const auditPageSize = 500
+
+// AuditRecord describes a single mutating API call
+type AuditRecord struct {
+	Timestamp int64  `json:"ts"`
+	Actor     string `json:"actor"`
+	SourceIP  string `json:"ip"`
+	Action    string `json:"action"`
+	Env       string `json:"env,omitempty"`
+	Service   string `json:"service"`
+	Key       string `json:"key,omitempty"`
+	OldValue  string `json:"old,omitempty"`
+	NewValue  string `json:"new,omitempty"`
+	// Detail describes changes which are not configuration values, like the version of a rollback
+	Detail string `json:"detail,omitempty"`
+	Status int    `json:"status"`
+	Result string `json:"result"`
+}
+
+// AuditFilter selects audit records, empty fields match everything
+type AuditFilter struct {
+	Env     string
+	Service string
+	Key     string
+	Actor   string
+	From    time.Time
+	To      time.Time
+	// Visible selects the records the reader is allowed to see, Limit counts only the visible records
+	Visible func(AuditRecord) bool
+	Limit   int
+}
+
+func (f AuditFilter) matches(record AuditRecord) bool {
+	// Calls of routes without an environment are made to the default one
+	env := record.Env
+	if env == "" && record.Service != "" {
+		env = DefaultEnv
+	}
+	return (f.Env == "" || f.Env == env) &&
+		(f.Service == "" || f.Service == record.Service) &&
+		(f.Key == "" || f.Key == record.Key) &&
+		(f.Actor == "" || f.Actor == record.Actor) &&
+		(f.Visible == nil || f.Visible(record))
+}
+
+// auditKey returns a time ordered key for the audit record
+func auditKey(t time.Time) string {
+	return fmt.Sprintf("%s%019d-%s", auditPrefix, t.UnixNano(), newClientID())
+}
+
+// AddAuditRecord stores the audit record
+func (cc *CCService) AddAuditRecord(record AuditRecord) error {
+	data, err := json.Marshal(record)
+	if err != nil {
+		return errors.Wrap(err, "Could not convert to JSON")
+	}
+	return cc.putKey(auditKey(time.Now()), string(data))
+}
+
+// GetAuditRecords returns audit records matching the filter, newest first
+func (cc *CCService) GetAuditRecords(filter AuditFilter) ([]AuditRecord, error) {
+	start := auditPrefix
+	end := clientv3.GetPrefixRangeEnd(auditPrefix)
+	if !filter.From.IsZero() {
+		start = auditKey(filter.From)[:len(auditPrefix)+19]
+	}
+	if !filter.To.IsZero() {
+		end = auditKey(filter.To.Add(time.Second))[:len(auditPrefix)+19]
+	}
+	records := make([]AuditRecord, 0)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp, err := cc.etcd.Get(ctx, start,
+			clientv3.WithRange(end),
+			clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+			clientv3.WithLimit(auditPageSize))
+		cancel()
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not get audit records")
+		}
+		for _, kv := range resp.Kvs {
+			record := AuditRecord{}
+			err = json.Unmarshal(kv.Value, &record)
+			if err != nil {
+				return nil, errors.Wrap(err, "Could not unmarshal audit record "+string(kv.Key))
+			}
+			if !filter.matches(record) {
+				continue
+			}
+			records = append(records, record)
+			if filter.Limit > 0 && len(records) == filter.Limit {
+				return records, nil
+			}
+		}
+		if len(resp.Kvs) < auditPageSize {
+			return records, nil
+		}
+		// The next page continues below the oldest record read, range end is exclusive
+		end = string(resp.Kvs[len(resp.Kvs)-1].Key)
+	}
+}
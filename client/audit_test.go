@@ -0,0 +1,25 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAuditFilter(t *testing.T) {
+	legacy := AuditRecord{Service: "service1"}
+	staging := AuditRecord{Env: "staging", Service: "service1"}
+	policy := AuditRecord{Action: "policy"}
+
+	filter := AuditFilter{Env: DefaultEnv}
+	assert.True(t, filter.matches(legacy))
+	assert.True(t, filter.matches(AuditRecord{Env: DefaultEnv, Service: "service1"}))
+	assert.False(t, filter.matches(staging))
+	assert.False(t, filter.matches(policy))
+	assert.True(t, AuditFilter{Env: "staging"}.matches(staging))
+	assert.True(t, AuditFilter{}.matches(policy))
+
+	filter = AuditFilter{Visible: func(record AuditRecord) bool { return record.Service != "" }}
+	assert.True(t, filter.matches(staging))
+	assert.False(t, filter.matches(policy))
+}
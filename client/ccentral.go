@@ -1,12 +1,18 @@
 package client
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"log"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-// CCentralService is base struct for CCentral services
+// CCentralService is base struct for CCentral services, it is safe for concurrent use
 type CCentralService struct {
 	CheckIntervalSeconds int64
 	lastCheck            int64
@@ -14,6 +20,19 @@ type CCentralService struct {
 	config               map[string]ConfigItem
 	schema               map[string]SchemaItem
 	cc                   CCApi
+	// mu guards the fields of the service, updateMu serializes configuration refreshes
+	mu         sync.RWMutex
+	updateMu   sync.Mutex
+	callbacks  map[string][]func(oldValue, newValue string)
+	stopWatch  context.CancelFunc
+	clientID   string
+	started    int64
+	info       map[string]string
+	interval   time.Duration
+	stopReport context.CancelFunc
+	metrics    *metrics
+	keyring    *Keyring
+	hostname   string
 }
 
 // NewService - Create a new service container
@@ -27,60 +46,233 @@ func NewService(
 
 // InitCCentralService returns service struct for easier configuration access
 func InitCCentralService(cc CCApi, serviceID string) *CCentralService {
+	hostname, _ := os.Hostname()
 	service := CCentralService{
 		servideID: serviceID,
 		schema:    make(map[string]SchemaItem),
 		config:    make(map[string]ConfigItem),
+		callbacks: make(map[string][]func(oldValue, newValue string)),
+		clientID:  newClientID(),
+		started:   time.Now().Unix(),
+		info:      make(map[string]string),
+		interval:  defaultReportInterval,
+		metrics:   newMetrics(),
+		hostname:  hostname,
 		cc:        cc}
 	return &service
 }
 
+// InitCCentralServiceInEnv returns service struct for the service in the environment, see CCApi.Env
+func InitCCentralServiceInEnv(cc CCApi, env string, serviceID string) *CCentralService {
+	return InitCCentralService(cc.Env(env), serviceID)
+}
+
 // AddSchema adds a single schema item into configuration
 func (s *CCentralService) AddSchema(configID string, defaultValue string, valueType string, title string, description string) {
+	s.AddSchemaWithOptions(configID, defaultValue, valueType, title, description)
+}
+
+// AddSchemaWithOptions adds a single schema item with constraints into configuration. Keys containing
+// "@" are ignored as they are reserved for overrides.
+func (s *CCentralService) AddSchemaWithOptions(configID string, defaultValue string, valueType string, title string, description string, opts ...SchemaOption) {
+	if strings.Contains(configID, "@") {
+		log.Printf("Schema key %v ignored: %v", configID, ErrInvalidSchemaKey)
+		return
+	}
 	i := SchemaItem{Default: defaultValue, Type: valueType, Title: title, Description: description}
+	for _, opt := range opts {
+		opt(&i)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	s.schema[configID] = i
 }
 
-// UpdateConfig updates configuration CheckIntervalSeconds has passed since last check
-func (s *CCentralService) UpdateConfig() error {
-	if time.Now().Unix()-s.CheckIntervalSeconds > s.lastCheck {
-		return s.ForceUpdateConfig()
+// schemaCopy returns a snapshot of the schema which can be used without holding the lock
+func (s *CCentralService) schemaCopy() map[string]SchemaItem {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	schema := make(map[string]SchemaItem, len(s.schema))
+	for k, v := range s.schema {
+		schema[k] = v
+	}
+	return schema
+}
+
+// publishSchema writes the schema to etcd unless it has been written already, must hold updateMu
+func (s *CCentralService) publishSchema() error {
+	s.mu.RLock()
+	published := s.lastCheck != 0
+	s.mu.RUnlock()
+	if published {
+		return nil
+	}
+	return s.cc.SetSchema(s.servideID, s.schemaCopy())
+}
+
+func (s *CCentralService) markChecked() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastCheck = time.Now().Unix()
+}
+
+// OnChange registers a callback which is called with the old and the new value whenever the value of
+// the configuration option changes. Callbacks are called from the goroutine applying the update.
+func (s *CCentralService) OnChange(configID string, callback func(oldValue, newValue string)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.callbacks[configID] = append(s.callbacks[configID], callback)
+}
+
+// StartWatch switches the service to watch mode. Configuration changes are pushed from etcd as they
+// happen instead of being polled every CheckIntervalSeconds.
+func (s *CCentralService) StartWatch() error {
+	watcher, ok := s.cc.(CCWatchApi)
+	if !ok {
+		return errors.New("Configuration watching is not supported by the API")
+	}
+	s.mu.Lock()
+	if s.stopWatch != nil {
+		s.mu.Unlock()
+		return errors.New("Configuration is already being watched")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopWatch = cancel
+	s.mu.Unlock()
+
+	s.updateMu.Lock()
+	err := s.publishSchema()
+	if err != nil {
+		log.Printf("Could not publish schema for %v: %v", s.servideID, err)
 	}
+	s.markChecked()
+	s.updateMu.Unlock()
+	go func() {
+		for config := range watcher.WatchConfig(ctx, s.servideID) {
+			s.applyConfig(config)
+		}
+	}()
 	return nil
 }
 
+// StopWatch stops watch mode and returns to polling the configuration
+func (s *CCentralService) StopWatch() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
+}
+
+// UpdateConfig updates configuration CheckIntervalSeconds has passed since last check
+func (s *CCentralService) UpdateConfig() error {
+	return s.refresh(false)
+}
+
 // ForceUpdateConfig will force configuration update
 func (s *CCentralService) ForceUpdateConfig() error {
-	if s.lastCheck == 0 {
-		err := s.cc.SetSchema(s.servideID, s.schema)
-		if err != nil {
-			s.lastCheck = time.Now().Unix()
-			return err
-		}
+	return s.refresh(true)
+}
+
+// due tells if the configuration should be polled again
+func (s *CCentralService) due() bool {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.stopWatch == nil && time.Now().Unix()-s.CheckIntervalSeconds > s.lastCheck
+}
+
+func (s *CCentralService) refresh(force bool) error {
+	if !force && !s.due() {
+		return nil
+	}
+	s.updateMu.Lock()
+	defer s.updateMu.Unlock()
+	// Another goroutine may have refreshed the configuration while we were waiting
+	if !force && !s.due() {
+		return nil
+	}
+	err := s.publishSchema()
+	if err != nil {
+		s.markChecked()
+		return err
 	}
 	config, err := s.cc.GetConfig(s.servideID)
-	s.lastCheck = time.Now().Unix()
+	s.markChecked()
 	if err != nil {
 		return err
 	}
-	s.config = config
+	s.applyConfig(config)
 	return nil
 }
 
-// GetConfig returns single configuration option
+// applyConfig swaps in the new configuration and notifies callbacks of the options that changed
+func (s *CCentralService) applyConfig(config map[string]ConfigItem) {
+	type change struct {
+		oldValue, newValue string
+		callbacks          []func(oldValue, newValue string)
+	}
+	var changes []change
+	s.mu.Lock()
+	old := s.config
+	s.config = config
+	for configID, callbacks := range s.callbacks {
+		// Values which can not be decrypted are not reported, GetConfig returns the error instead
+		oldValue, _ := s.plainValue(old, configID)
+		newValue, _ := s.plainValue(config, configID)
+		if oldValue != newValue {
+			changes = append(changes, change{oldValue: oldValue, newValue: newValue, callbacks: callbacks})
+		}
+	}
+	s.mu.Unlock()
+	for _, c := range changes {
+		for _, callback := range c.callbacks {
+			callback(c.oldValue, c.newValue)
+		}
+	}
+}
+
+// SetKeyring sets the keyring used to decrypt encrypted password values
+func (s *CCentralService) SetKeyring(keyring *Keyring) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keyring = keyring
+}
+
+// plainValue returns the value of the option with encrypted password values decrypted, must hold mu
+func (s *CCentralService) plainValue(config map[string]ConfigItem, configID string) (string, error) {
+	value := s.value(config, configID)
+	// Other types may contain values which only look encrypted
+	if s.schema[configID].Type != TypePassword || !IsEncrypted(value) {
+		return value, nil
+	}
+	if s.keyring == nil {
+		return "", errors.New("Option " + configID + " is encrypted but no keyring has been set")
+	}
+	return s.keyring.Decrypt(value)
+}
+
+// value returns the value overridden for this instance, the configured value or the schema default
+// when the option is not set, must hold mu
+func (s *CCentralService) value(config map[string]ConfigItem, configID string) string {
+	return Resolve(s.schema, config, configID, s.target()).Value
+}
+
+// target returns the instance overrides are resolved for, must hold mu
+func (s *CCentralService) target() Target {
+	return Target{ClientID: s.clientID, Hostname: s.hostname, Tags: s.info}
+}
+
+// GetConfig returns single configuration option, encrypted values are decrypted with the keyring
 func (s *CCentralService) GetConfig(configID string) (string, error) {
 	s.UpdateConfig()
-	defaultItem, ok := s.schema[configID]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	_, ok := s.schema[configID]
 	if !ok {
 		return "", errors.New("Schema has not been defined for option " + configID)
 	}
-	valueItem, ok := s.config[configID]
-	if ok {
-		if len(valueItem.Value) > 0 {
-			return valueItem.Value, nil
-		}
-	}
-	return defaultItem.Default, nil
+	return s.plainValue(s.config, configID)
 }
 
 // GetConfigBool returns boolean value of the configuration options
@@ -108,3 +300,65 @@ func (s *CCentralService) GetConfigInt(configID string) (int, error) {
 	}
 	return iValue, nil
 }
+
+// getTypedConfig returns the value of an option after checking it has been declared with one of the types
+func (s *CCentralService) getTypedConfig(configID string, types ...string) (string, error) {
+	value, err := s.GetConfig(configID)
+	if err != nil {
+		return "", err
+	}
+	s.mu.RLock()
+	valueType := s.schema[configID].Type
+	s.mu.RUnlock()
+	for _, t := range types {
+		if t == valueType {
+			return value, nil
+		}
+	}
+	return "", fmt.Errorf(`Option %v is declared as "%v", expected "%v"`, configID, valueType, strings.Join(types, `" or "`))
+}
+
+// GetConfigFloat returns float value of the configuration options
+func (s *CCentralService) GetConfigFloat(configID string) (float64, error) {
+	value, err := s.getTypedConfig(configID, TypeFloat, TypeInteger)
+	if err != nil {
+		return 0, err
+	}
+	fValue, err := strconv.ParseFloat(value, 64)
+	if err != nil {
+		return 0, fmt.Errorf("Option %v does not contain a valid float: %q", configID, value)
+	}
+	return fValue, nil
+}
+
+// GetConfigList returns list value of the configuration options
+func (s *CCentralService) GetConfigList(configID string) ([]string, error) {
+	value, err := s.getTypedConfig(configID, TypeList)
+	if err != nil {
+		return nil, err
+	}
+	list, err := ParseList(value)
+	if err != nil {
+		return nil, fmt.Errorf("Option %v does not contain a valid list: %v", configID, err)
+	}
+	return list, nil
+}
+
+// GetConfigDuration returns duration value of the configuration options. Options of type "integer" are
+// interpreted as seconds.
+func (s *CCentralService) GetConfigDuration(configID string) (time.Duration, error) {
+	value, err := s.getTypedConfig(configID, TypeDuration, TypeInteger)
+	if err != nil {
+		return 0, err
+	}
+	d, err := ParseDuration(value)
+	if err != nil {
+		return 0, fmt.Errorf("Option %v does not contain a valid duration: %v", configID, err)
+	}
+	return d, nil
+}
+
+// GetConfigPassword returns value of a password option
+func (s *CCentralService) GetConfigPassword(configID string) (string, error) {
+	return s.getTypedConfig(configID, TypePassword)
+}
@@ -0,0 +1,161 @@
+package client
+
+import (
+	"fmt"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// mockApi keeps configuration in memory, methods not needed by CCentralService panic through the nil CCApi
+type mockApi struct {
+	CCApi
+	mu     sync.Mutex
+	config map[string]ConfigItem
+	schema map[string]SchemaItem
+}
+
+func newMockApi() *mockApi {
+	return &mockApi{config: make(map[string]ConfigItem)}
+}
+
+func (m *mockApi) SetSchema(serviceID string, schema map[string]SchemaItem) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.schema = schema
+	return nil
+}
+
+func (m *mockApi) GetConfig(serviceID string) (map[string]ConfigItem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	config := make(map[string]ConfigItem, len(m.config))
+	for k, v := range m.config {
+		config[k] = v
+	}
+	return config, nil
+}
+
+func (m *mockApi) set(keyID string, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.config[keyID] = ConfigItem{Value: value}
+}
+
+func TestGetConfigReturnsDefault(t *testing.T) {
+	service := InitCCentralService(newMockApi(), "service1")
+	service.AddSchema("key", "default", "string", "Key", "Key")
+	value, err := service.GetConfig("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "default", value)
+}
+
+func TestGetConfigReturnsConfiguredValue(t *testing.T) {
+	api := newMockApi()
+	api.set("key", "value")
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("key", "default", "string", "Key", "Key")
+	value, err := service.GetConfig("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestGetConfigUnknownKey(t *testing.T) {
+	service := InitCCentralService(newMockApi(), "service1")
+	_, err := service.GetConfig("key")
+	assert.Error(t, err)
+}
+
+func TestOnChangeIsCalledForChangedValues(t *testing.T) {
+	api := newMockApi()
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("key", "default", "string", "Key", "Key")
+	service.AddSchema("other", "default", "string", "Other", "Other")
+	var changes []string
+	service.OnChange("key", func(oldValue, newValue string) {
+		changes = append(changes, oldValue+"->"+newValue)
+	})
+	assert.NoError(t, service.ForceUpdateConfig())
+	api.set("key", "value")
+	api.set("other", "value")
+	assert.NoError(t, service.ForceUpdateConfig())
+	assert.NoError(t, service.ForceUpdateConfig())
+	assert.Equal(t, []string{"default->value"}, changes)
+}
+
+func TestConcurrentAccess(t *testing.T) {
+	api := newMockApi()
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("key", "0", "integer", "Key", "Key")
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				switch j % 4 {
+				case 0:
+					_, err := service.GetConfigInt("key")
+					assert.NoError(t, err)
+				case 1:
+					service.AddSchema(fmt.Sprintf("key-%d-%d", i, j), "", "string", "", "")
+				case 2:
+					api.set("key", strconv.Itoa(i*j))
+					assert.NoError(t, service.ForceUpdateConfig())
+				case 3:
+					service.OnChange("key", func(oldValue, newValue string) {})
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestTypedGetters(t *testing.T) {
+	api := newMockApi()
+	api.set("float", "1.5")
+	api.set("list", `["a", "b"]`)
+	api.set("duration", "1m30s")
+	api.set("seconds", "30")
+	api.set("password", "secret")
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("float", "0", "float", "", "")
+	service.AddSchema("list", "[]", "list", "", "")
+	service.AddSchema("duration", "1s", "duration", "", "")
+	service.AddSchema("seconds", "1", "integer", "", "")
+	service.AddSchema("password", "", "password", "", "")
+
+	f, err := service.GetConfigFloat("float")
+	assert.NoError(t, err)
+	assert.Equal(t, 1.5, f)
+	l, err := service.GetConfigList("list")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, l)
+	d, err := service.GetConfigDuration("duration")
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, d)
+	d, err = service.GetConfigDuration("seconds")
+	assert.NoError(t, err)
+	assert.Equal(t, 30*time.Second, d)
+	p, err := service.GetConfigPassword("password")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", p)
+}
+
+func TestTypedGettersValidateType(t *testing.T) {
+	api := newMockApi()
+	api.set("list", "not a list")
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("string", "text", "string", "", "")
+	service.AddSchema("list", "[]", "list", "", "")
+
+	_, err := service.GetConfigFloat("string")
+	assert.EqualError(t, err, `Option string is declared as "string", expected "float" or "integer"`)
+	_, err = service.GetConfigPassword("string")
+	assert.Error(t, err)
+	_, err = service.GetConfigList("list")
+	assert.Error(t, err)
+}
@@ -0,0 +1,298 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/mvcc/mvccpb"
+	"github.com/pkg/errors"
+)
+
+// maxBatchOps keeps archive and restore transactions below the default etcd limit of 128 operations
+const maxBatchOps = 100
+
+// maxBatchBytes keeps archive and restore transactions below the default etcd request size of 1.5 MiB
+const maxBatchBytes = 1 << 20
+
+// ErrKeyNotSet is returned when deleting a configuration value which has not been set
+var ErrKeyNotSet = errors.New("Configuration value has not been set")
+
+// ErrServiceNotFound is returned when the service does not exist
+var ErrServiceNotFound = errors.New("Service not found")
+
+// ErrServiceExists is returned when restoring a service which already exists
+var ErrServiceExists = errors.New("Service already exists")
+
+// ErrArchiveNotFound is returned when the archived service does not exist
+var ErrArchiveNotFound = errors.New("Archived service not found")
+
+// ArchivedService is a soft-deleted service. The service tree, except the instance heartbeats, is
+// stored with one key per entry under archive/SERVICE_ID/ARCHIVE_ID/keys/.
+type ArchivedService struct {
+	ID        string `json:"id"`
+	Service   string `json:"service"`
+	Timestamp int64  `json:"ts"`
+	Actor     string `json:"actor"`
+	// Restoring is set while the tree is written back, see RestoreService
+	Restoring bool `json:"restoring,omitempty"`
+}
+
+// archiveKey returns the directory of the archived service
+func (cc *CCService) archiveKey(serviceID string, archiveID string) string {
+	return cc.archivePrefix() + serviceID + "/" + archiveID + "/"
+}
+
+// StaleKeys returns the configuration values (and overrides) which no longer have a schema entry
+func StaleKeys(schema map[string]SchemaItem, config map[string]ConfigItem) map[string]ConfigItem {
+	stale := make(map[string]ConfigItem)
+	for keyID, item := range config {
+		if _, ok := SchemaItemFor(schema, keyID); ok || keyID == "v" {
+			continue
+		}
+		stale[keyID] = item
+	}
+	return stale
+}
+
+// DeleteConfigItem removes the configuration value so that the schema default is used again. The
+// removal increments the version and is recorded into the history.
+func (cc *CCService) DeleteConfigItem(serviceID string, keyID string, opts WriteOptions) (string, error) {
+	return cc.updateConfig(serviceID, opts, func(config map[string]ConfigItem) error {
+		if _, ok := config[keyID]; !ok || keyID == "v" {
+			return ErrKeyNotSet
+		}
+		delete(config, keyID)
+		return nil
+	})
+}
+
+// DeleteSchemaItem removes the key from the service schema. Clients publishing the key will add it back.
+func (cc *CCService) DeleteSchemaItem(serviceID string, keyID string) error {
+	schema, err := cc.GetSchema(serviceID)
+	if err != nil {
+		return err
+	}
+	if _, ok := schema[keyID]; !ok {
+		return errors.Errorf("Key %v not found from the schema", keyID)
+	}
+	delete(schema, keyID)
+	return cc.SetSchema(serviceID, schema)
+}
+
+// ArchiveService moves the service tree under the archive, after which the service is no longer
+// listed. The tree is copied first and removed in a single transaction with the archive becoming
+// visible, ErrConfigConflict is returned if the configuration or schema was changed in the meantime.
+// Running clients will recreate the service when they report in.
+func (cc *CCService) ArchiveService(serviceID string, actor string) (*ArchivedService, error) {
+	prefix := cc.serviceKey(serviceID, "")
+	resp, err := cc.getPrefix(prefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get service")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, ErrServiceNotFound
+	}
+	now := time.Now()
+	archive := &ArchivedService{
+		ID:        fmt.Sprintf("%019d", now.UnixNano()),
+		Service:   serviceID,
+		Timestamp: now.Unix(),
+		Actor:     actor,
+	}
+	dir := cc.archiveKey(serviceID, archive.ID)
+	configKey, schemaKey := cc.serviceKey(serviceID, "config"), cc.serviceKey(serviceID, "schema")
+	var configRevision, schemaRevision int64
+	entries := make([]*mvccpb.KeyValue, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), prefix)
+		if strings.HasPrefix(key, "clients/") {
+			continue
+		}
+		switch string(kv.Key) {
+		case configKey:
+			configRevision = kv.ModRevision
+		case schemaKey:
+			schemaRevision = kv.ModRevision
+		}
+		entries = append(entries, &mvccpb.KeyValue{Key: []byte(dir + "keys/" + key), Value: kv.Value})
+	}
+	err = cc.putBatches(entries)
+	if err != nil {
+		cc.deleteArchive(dir)
+		return nil, errors.Wrap(err, "Could not archive service")
+	}
+	data, err := json.Marshal(archive)
+	if err != nil {
+		cc.deleteArchive(dir)
+		return nil, errors.Wrap(err, "Could not convert to JSON")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	txn, err := cc.etcd.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(configKey), "=", configRevision),
+			clientv3.Compare(clientv3.ModRevision(schemaKey), "=", schemaRevision)).
+		Then(clientv3.OpPut(dir+"meta", string(data)), clientv3.OpDelete(prefix, clientv3.WithPrefix())).
+		Commit()
+	if err != nil {
+		// The transaction may still have been applied, the copied keys are kept
+		return nil, errors.Wrap(err, "Could not archive service")
+	}
+	if !txn.Succeeded {
+		cc.deleteArchive(dir)
+		return nil, ErrConfigConflict
+	}
+	return archive, nil
+}
+
+// deleteArchive removes the partially written archive, the keys are not listed without the meta key
+func (cc *CCService) deleteArchive(dir string) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := cc.etcd.Delete(ctx, dir, clientv3.WithPrefix())
+	if err != nil {
+		log.Printf("Could not remove partial archive %v: %v", dir, err)
+	}
+}
+
+// putBatches writes the keys in order with transactions small enough for the etcd request limits
+func (cc *CCService) putBatches(kvs []*mvccpb.KeyValue) error {
+	ops := make([]clientv3.Op, 0, maxBatchOps)
+	size := 0
+	for i, kv := range kvs {
+		ops = append(ops, clientv3.OpPut(string(kv.Key), string(kv.Value)))
+		size += len(kv.Key) + len(kv.Value)
+		if i < len(kvs)-1 && len(ops) < maxBatchOps && size+len(kvs[i+1].Key)+len(kvs[i+1].Value) <= maxBatchBytes {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		_, err := cc.etcd.Txn(ctx).Then(ops...).Commit()
+		cancel()
+		if err != nil {
+			return err
+		}
+		ops, size = ops[:0], 0
+	}
+	return nil
+}
+
+// getArchive returns the archived service and the revision of its meta key
+func (cc *CCService) getArchive(serviceID string, archiveID string) (*ArchivedService, int64, error) {
+	key := cc.archiveKey(serviceID, archiveID) + "meta"
+	resp, err := cc.getKey(key)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not get archived service")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, 0, ErrArchiveNotFound
+	}
+	archive := &ArchivedService{}
+	err = json.Unmarshal(resp.Kvs[0].Value, archive)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not unmarshal archived service "+key)
+	}
+	return archive, resp.Kvs[0].ModRevision, nil
+}
+
+// GetArchivedServices returns the archived services newest first, only the meta key of each archive is read
+func (cc *CCService) GetArchivedServices() ([]ArchivedService, error) {
+	services, err := cc.childSegments(cc.archivePrefix())
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get archived services")
+	}
+	archives := make([]ArchivedService, 0)
+	for _, serviceID := range services {
+		ids, err := cc.childSegments(cc.archivePrefix() + serviceID + "/")
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not get archived services")
+		}
+		for _, archiveID := range ids {
+			archive, _, err := cc.getArchive(serviceID, archiveID)
+			if errors.Cause(err) == ErrArchiveNotFound {
+				// Partially written archive
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			archives = append(archives, *archive)
+		}
+	}
+	sort.Slice(archives, func(i, j int) bool { return archives[i].ID > archives[j].ID })
+	return archives, nil
+}
+
+// RestoreService writes the archived service tree back and removes it from the archive. Restoring
+// fails with ErrServiceExists if the service has been recreated in the meantime. The tree is written
+// with several transactions, a restore which failed part way is continued by restoring again.
+func (cc *CCService) RestoreService(serviceID string, archiveID string) error {
+	dir := cc.archiveKey(serviceID, archiveID)
+	archive, revision, err := cc.getArchive(serviceID, archiveID)
+	if err != nil {
+		return err
+	}
+	if !archive.Restoring {
+		existing, err := cc.getPrefix(cc.serviceKey(serviceID, ""), clientv3.WithKeysOnly(), clientv3.WithLimit(1))
+		if err != nil {
+			return errors.Wrap(err, "Could not get service")
+		}
+		if len(existing.Kvs) > 0 {
+			return ErrServiceExists
+		}
+		// Marking the archive lets a failed restore be retried over the keys it has written already
+		archive.Restoring = true
+		data, err := json.Marshal(archive)
+		if err != nil {
+			return errors.Wrap(err, "Could not convert to JSON")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		txn, err := cc.etcd.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(dir+"meta"), "=", revision)).
+			Then(clientv3.OpPut(dir+"meta", string(data))).
+			Commit()
+		cancel()
+		if err != nil {
+			return errors.Wrap(err, "Could not restore service")
+		}
+		if !txn.Succeeded {
+			return ErrConfigConflict
+		}
+	}
+	resp, err := cc.getPrefix(dir+"keys/", clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend))
+	if err != nil {
+		return errors.Wrap(err, "Could not get archived service")
+	}
+	// Configuration is restored last, together with the removal of the archive, so that it is only
+	// visible once the rest of the tree exists
+	entries := make([]*mvccpb.KeyValue, 0, len(resp.Kvs))
+	var config *mvccpb.KeyValue
+	for _, kv := range resp.Kvs {
+		key := strings.TrimPrefix(string(kv.Key), dir+"keys/")
+		entry := &mvccpb.KeyValue{Key: []byte(cc.serviceKey(serviceID, key)), Value: kv.Value}
+		if key == "config" {
+			config = entry
+		} else {
+			entries = append(entries, entry)
+		}
+	}
+	err = cc.putBatches(entries)
+	if err != nil {
+		return errors.Wrap(err, "Could not restore service, restore again to continue")
+	}
+	ops := []clientv3.Op{clientv3.OpDelete(dir, clientv3.WithPrefix())}
+	if config != nil {
+		ops = append(ops, clientv3.OpPut(string(config.Key), string(config.Value)))
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err = cc.etcd.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return errors.Wrap(err, "Could not restore service, restore again to continue")
+	}
+	return nil
+}
@@ -0,0 +1,19 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestStaleKeys(t *testing.T) {
+	schema := map[string]SchemaItem{"current": {Type: TypeString}}
+	config := map[string]ConfigItem{
+		"v":       {Value: "3"},
+		"current": {Value: "value"},
+		"old":     {Value: "This config should not be shown"},
+	}
+	stale := StaleKeys(schema, config)
+	assert.Equal(t, map[string]ConfigItem{"old": {Value: "This config should not be shown"}}, stale)
+	assert.Empty(t, StaleKeys(schema, map[string]ConfigItem{"v": {Value: "1"}}))
+}
@@ -0,0 +1,93 @@
+package client
+
+// DiffSource is one side of a configuration diff, password values are in plain text
+type DiffSource struct {
+	Label  string
+	Schema map[string]SchemaItem
+	Config map[string]string
+}
+
+// ConfigDiff lists the configuration and schema differences between two sources
+type ConfigDiff struct {
+	From   string   `json:"from"`
+	To     string   `json:"to"`
+	Config []Change `json:"config"`
+	Schema []Change `json:"schema"`
+}
+
+// GetDiffSource returns the schema and decrypted configuration of the service at the given version,
+// the current configuration when version is 0. Schema is not versioned so the current one is used.
+func (cc *CCService) GetDiffSource(serviceID string, version int) (*DiffSource, error) {
+	schema, err := cc.GetSchema(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	var config map[string]ConfigItem
+	if version > 0 {
+		config, err = cc.GetConfigAtVersion(serviceID, version)
+	} else {
+		config, err = cc.GetConfig(serviceID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	values := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != "v" {
+			values[k] = cc.decryptValue(v.Value)
+		}
+	}
+	return &DiffSource{Label: serviceID + "@" + ConfigVersion(config), Schema: schema, Config: values}, nil
+}
+
+// ExportDiffSource returns the service of an export document as a diff source
+func (cc *CCService) ExportDiffSource(label string, data ServiceExport) *DiffSource {
+	values := make(map[string]string, len(data.Config))
+	for k, v := range data.Config {
+		values[k] = cc.decryptValue(v)
+	}
+	return &DiffSource{Label: label, Schema: data.Schema, Config: values}
+}
+
+// maskedValue replaces the values of password keys in diffs
+const maskedValue = "******"
+
+// isPassword tells if the key has been declared as a password on either side
+func isPassword(from *DiffSource, to *DiffSource, keyID string) bool {
+	return from.Schema[BaseKey(keyID)].Type == TypePassword || to.Schema[BaseKey(keyID)].Type == TypePassword
+}
+
+// Diff compares the configuration and schema of the sources. Values of keys declared as passwords on
+// either side are compared but not returned, the change only tells that the value differs.
+func Diff(from *DiffSource, to *DiffSource) *ConfigDiff {
+	changes := DiffValues(from.Config, to.Config)
+	for i, change := range changes {
+		if !isPassword(from, to, change.Key) {
+			continue
+		}
+		if change.Old != "" {
+			changes[i].Old = maskedValue
+		}
+		if change.New != "" {
+			changes[i].New = maskedValue
+		}
+	}
+	return &ConfigDiff{
+		From:   from.Label,
+		To:     to.Label,
+		Config: changes,
+		Schema: DiffValues(schemaValues(from.Schema), schemaValues(to.Schema)),
+	}
+}
+
+// OmitPasswords removes the password keys from both sources, used when the caller could choose the
+// values of one side and would otherwise learn whether a guessed password matches
+func OmitPasswords(from *DiffSource, to *DiffSource) {
+	for _, source := range []*DiffSource{from, to} {
+		for k := range source.Config {
+			if isPassword(from, to, k) {
+				delete(source.Config, k)
+			}
+		}
+	}
+}
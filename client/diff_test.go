@@ -0,0 +1,42 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffMasksPasswords(t *testing.T) {
+	from := &DiffSource{
+		Label:  "service1@3",
+		Schema: map[string]SchemaItem{"host": {Type: TypeString}, "password": {Type: TypePassword}},
+		Config: map[string]string{"host": "db1", "password": "secret"},
+	}
+	to := &DiffSource{
+		Label:  "service2@5",
+		Schema: map[string]SchemaItem{"host": {Type: TypeString}, "password": {Type: TypePassword}, "port": {Type: TypeInteger}},
+		Config: map[string]string{"host": "db2", "password": "other"},
+	}
+	diff := Diff(from, to)
+	assert.Equal(t, "service1@3", diff.From)
+	assert.Equal(t, "service2@5", diff.To)
+	assert.Len(t, diff.Config, 2)
+	assert.Equal(t, Change{Key: "host", Action: "changed", Old: "db1", New: "db2"}, diff.Config[0])
+	assert.Equal(t, Change{Key: "password", Action: "changed", Old: "******", New: "******"}, diff.Config[1])
+	assert.Len(t, diff.Schema, 1)
+	assert.Equal(t, "port", diff.Schema[0].Key)
+
+	to.Config["password"] = "secret"
+	assert.Len(t, Diff(from, to).Config, 1)
+}
+
+func TestOmitPasswords(t *testing.T) {
+	from := &DiffSource{
+		Schema: map[string]SchemaItem{"host": {Type: TypeString}, "password": {Type: TypePassword}},
+		Config: map[string]string{"host": "db1", "password": "secret", "password@host:web-1": "secret"},
+	}
+	to := &DiffSource{Config: map[string]string{"host": "db1", "password": "guess"}}
+	OmitPasswords(from, to)
+	assert.Equal(t, map[string]string{"host": "db1"}, from.Config)
+	assert.Empty(t, Diff(from, to).Config)
+}
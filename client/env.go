@@ -0,0 +1,128 @@
+package client
+
+import (
+	"regexp"
+	"sort"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// DefaultEnv is the environment stored directly under /ccentral/services/
+const DefaultEnv = "default"
+
+const ccentralRoot = "/ccentral/"
+
+var envPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// reservedEnvs collide with keys stored directly under the CCentral root
+var reservedEnvs = map[string]bool{"services": true, "archive": true, "audit": true, "rbac": true, "envs": true, "schedule": true, "approvals": true}
+
+// ValidateEnv checks that the environment name can be used as a namespace
+func ValidateEnv(env string) error {
+	if env == "" || env == DefaultEnv {
+		return nil
+	}
+	if !envPattern.MatchString(env) {
+		return errors.Errorf("Environment %v must contain only lower case letters, digits, '-' and '_'", env)
+	}
+	if reservedEnvs[env] {
+		return errors.Errorf("Environment name %v is reserved", env)
+	}
+	return nil
+}
+
+// envRoot returns the root of the environment, named environments are stored under /ccentral/ENV/
+func envRoot(env string) string {
+	if env == "" || env == DefaultEnv {
+		return ccentralRoot
+	}
+	return ccentralRoot + env + "/"
+}
+
+func (cc *CCService) servicesPrefix() string {
+	return envRoot(cc.env) + "services/"
+}
+
+func (cc *CCService) archivePrefix() string {
+	return envRoot(cc.env) + "archive/"
+}
+
+// Env returns the API of the environment sharing the connection and keyring of cc. The environment
+// name must be valid, see ValidateEnv.
+func (cc *CCService) Env(env string) CCApi {
+	c := *cc
+	c.env = env
+	if env == DefaultEnv {
+		c.env = ""
+	}
+	return &c
+}
+
+// EnvName returns the name of the environment of the API
+func (cc *CCService) EnvName() string {
+	if cc.env == "" {
+		return DefaultEnv
+	}
+	return cc.env
+}
+
+// GetEnvironments returns the environments containing services, the default environment is always
+// listed. Only the first key below every environment and its services is read.
+func (cc *CCService) GetEnvironments() ([]string, error) {
+	roots, err := cc.childSegments(ccentralRoot)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get environments")
+	}
+	envs := []string{DefaultEnv}
+	for _, env := range roots {
+		if reservedEnvs[env] || env == DefaultEnv {
+			continue
+		}
+		resp, err := cc.getPrefix(envRoot(env)+"services/", clientv3.WithKeysOnly(), clientv3.WithLimit(1))
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not get environments")
+		}
+		if len(resp.Kvs) > 0 {
+			envs = append(envs, env)
+		}
+	}
+	sort.Strings(envs)
+	return envs, nil
+}
+
+// PromoteConfig copies the configured values of the keys (every configured key when keys is empty)
+// of the service into the same service of the target environment. Values are validated against the
+// target schema and written with a single version increment, keys which have not been configured are
+// skipped. See ImportOptions.DryRun for checking the changes first.
+func (cc *CCService) PromoteConfig(serviceID string, target string, keys []string, opts ImportOptions, write WriteOptions) (*ImportResult, error) {
+	err := ValidateEnv(target)
+	if err != nil {
+		return nil, err
+	}
+	config, err := cc.GetConfig(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	targetAPI := cc.Env(target).(*CCService)
+	targetSchema, err := targetAPI.GetSchema(serviceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Service must exist in the target environment")
+	}
+	if len(keys) == 0 {
+		for keyID := range config {
+			if keyID != "v" {
+				keys = append(keys, keyID)
+			}
+		}
+	}
+	values := make(map[string]string, len(keys))
+	for _, keyID := range keys {
+		if item, ok := config[keyID]; ok && keyID != "v" {
+			values[keyID] = item.Value
+		}
+	}
+	// Import keeps the target schema as is, only the values are merged
+	opts.Replace = false
+	return targetAPI.ImportService(serviceID, ServiceExport{Schema: targetSchema, Config: values}, opts, write)
+}
@@ -0,0 +1,30 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateEnv(t *testing.T) {
+	assert.NoError(t, ValidateEnv(""))
+	assert.NoError(t, ValidateEnv(DefaultEnv))
+	assert.NoError(t, ValidateEnv("staging"))
+	assert.NoError(t, ValidateEnv("eu-prod_2"))
+	assert.Error(t, ValidateEnv("Staging"))
+	assert.Error(t, ValidateEnv("a/b"))
+	assert.Error(t, ValidateEnv("audit"))
+	assert.Error(t, ValidateEnv("services"))
+	assert.Error(t, ValidateEnv("schedule"))
+}
+
+func TestEnvKeys(t *testing.T) {
+	cc := &CCService{}
+	assert.Equal(t, "/ccentral/services/service1/config", cc.serviceKey("service1", "config"))
+	staging := cc.Env("staging").(*CCService)
+	assert.Equal(t, "/ccentral/staging/services/service1/config", staging.serviceKey("service1", "config"))
+	assert.Equal(t, "/ccentral/staging/archive/service1/1/", staging.archiveKey("service1", "1"))
+	assert.Equal(t, "staging", staging.EnvName())
+	assert.Equal(t, DefaultEnv, cc.Env(DefaultEnv).EnvName())
+	assert.Equal(t, "/ccentral/services/service1/config", cc.Env(DefaultEnv).(*CCService).serviceKey("service1", "config"))
+}
@@ -0,0 +1,331 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// ExportFormatVersion is the version of the export document format
+const ExportFormatVersion = 1
+
+// How password values are handled in exports
+const (
+	// PasswordsExclude leaves password values out of the export
+	PasswordsExclude = "exclude"
+	// PasswordsEncrypted exports password values encrypted with the keyring
+	PasswordsEncrypted = "encrypted"
+	// PasswordsInclude exports password values in plain text
+	PasswordsInclude = "include"
+)
+
+// Export is a portable document of the schema, configuration and info of services
+type Export struct {
+	Version  int                      `json:"version"`
+	Exported int64                    `json:"exported"`
+	Services map[string]ServiceExport `json:"services"`
+}
+
+// ServiceExport contains the exported data of a single service, configuration version is not exported
+type ServiceExport struct {
+	Schema map[string]SchemaItem `json:"schema"`
+	Config map[string]string     `json:"config"`
+	Info   map[string]string     `json:"info,omitempty"`
+}
+
+// ImportOptions controls how an export is imported
+type ImportOptions struct {
+	// Replace removes schema entries and configuration values missing from the import. Password values
+	// are kept as they may have been excluded from the export, unless their schema entry is removed.
+	Replace bool
+	// DryRun only reports the changes the import would make
+	DryRun bool
+}
+
+// Change describes a single added, changed or removed value
+type Change struct {
+	Key    string `json:"key"`
+	Action string `json:"action"`
+	Old    string `json:"old,omitempty"`
+	New    string `json:"new,omitempty"`
+}
+
+// ImportResult lists the changes made (or with DryRun, to be made) by an import. Nothing is written
+// when Errors is not empty.
+type ImportResult struct {
+	Service string             `json:"service"`
+	DryRun  bool               `json:"dry_run"`
+	Schema  []Change           `json:"schema"`
+	Config  []Change           `json:"config"`
+	Errors  []*ValidationError `json:"errors,omitempty"`
+	Version string             `json:"version,omitempty"`
+	// Error is set when writing the service failed
+	Error string `json:"error,omitempty"`
+}
+
+// errNoChanges stops updateConfig from writing a configuration which did not change
+var errNoChanges = errors.New("No changes")
+
+// NewExport returns an empty export document of the current format version
+func NewExport() *Export {
+	return &Export{Version: ExportFormatVersion, Exported: time.Now().Unix(), Services: make(map[string]ServiceExport)}
+}
+
+// Validate checks that the export document can be imported
+func (e *Export) Validate() error {
+	if e.Version != ExportFormatVersion {
+		return errors.Errorf("Unsupported export version %v, expected %v", e.Version, ExportFormatVersion)
+	}
+	if len(e.Services) == 0 {
+		return errors.New("Export does not contain any services")
+	}
+	return nil
+}
+
+// DiffValues returns the changes between two sets of values ordered by key
+func DiffValues(before map[string]string, after map[string]string) []Change {
+	changes := make([]Change, 0)
+	for k, v := range after {
+		old, ok := before[k]
+		if !ok {
+			changes = append(changes, Change{Key: k, Action: "added", New: v})
+		} else if old != v {
+			changes = append(changes, Change{Key: k, Action: "changed", Old: old, New: v})
+		}
+	}
+	for k, v := range before {
+		if _, ok := after[k]; !ok {
+			changes = append(changes, Change{Key: k, Action: "removed", Old: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
+
+// ExportService returns the schema, configuration and info of the service, see Passwords* for the
+// handling of password values
+func (cc *CCService) ExportService(serviceID string, passwords string) (*ServiceExport, error) {
+	schema, err := cc.GetSchema(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	config, err := cc.GetConfig(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	info, err := cc.GetServiceInfoList(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	export := &ServiceExport{Schema: schema, Config: make(map[string]string, len(config)), Info: info}
+	for keyID, item := range config {
+		value := item.Value
+		if keyID == "v" {
+			continue
+		}
+		if schema[BaseKey(keyID)].Type == TypePassword && value != "" {
+			switch passwords {
+			case PasswordsExclude:
+				continue
+			case PasswordsEncrypted:
+				if !IsEncrypted(value) {
+					if cc.keyring == nil {
+						return nil, errors.New("Keyring is required for exporting encrypted passwords")
+					}
+					value, err = cc.keyring.Encrypt(value)
+				}
+			case PasswordsInclude:
+				if IsEncrypted(value) {
+					if cc.keyring == nil {
+						return nil, errors.New("Keyring is required for exporting passwords")
+					}
+					value, err = cc.keyring.Decrypt(value)
+				}
+			default:
+				return nil, errors.Errorf("Unknown password handling %v", passwords)
+			}
+			if err != nil {
+				return nil, errors.Wrap(err, keyID)
+			}
+		}
+		export.Config[keyID] = value
+	}
+	return export, nil
+}
+
+// ImportService writes the exported schema, configuration and info into the service, which may differ
+// from the exported one. Configuration is validated against the resulting schema and written with a
+// single version increment in the same transaction as the schema and info. ErrConfigConflict is
+// returned if the schema is changed during the import.
+func (cc *CCService) ImportService(serviceID string, data ServiceExport, opts ImportOptions, write WriteOptions) (*ImportResult, error) {
+	err := ValidateSchemaKeys(data.Schema)
+	if err != nil {
+		return nil, err
+	}
+	result := &ImportResult{Service: serviceID, DryRun: opts.DryRun}
+	schemaKey := cc.serviceKey(serviceID, "schema")
+	resp, err := cc.getKey(schemaKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not retrieve service schema")
+	}
+	schema := make(map[string]SchemaItem)
+	var schemaRevision int64
+	if len(resp.Kvs) > 0 {
+		schemaRevision = resp.Kvs[0].ModRevision
+		err = json.Unmarshal(resp.Kvs[0].Value, &schema)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not unmarshal service schema")
+		}
+	}
+	newSchema := make(map[string]SchemaItem, len(schema)+len(data.Schema))
+	if !opts.Replace {
+		for k, v := range schema {
+			newSchema[k] = v
+		}
+	}
+	for k, v := range data.Schema {
+		newSchema[k] = v
+	}
+	result.Schema = DiffValues(schemaValues(schema), schemaValues(newSchema))
+
+	plain := make(map[string]string, len(data.Config))
+	for keyID, value := range data.Config {
+		if IsEncrypted(value) {
+			if cc.keyring == nil {
+				return nil, errors.Errorf("Keyring is required for importing the encrypted value of %v", keyID)
+			}
+			value, err = cc.keyring.Decrypt(value)
+			if err != nil {
+				return nil, errors.Wrap(err, keyID)
+			}
+		}
+		plain[keyID] = value
+	}
+	result.Errors = ValidateConfigValues(newSchema, plain)
+	if result.Errors != nil {
+		return result, nil
+	}
+	values, err := cc.encryptWithSchema(newSchema, data.Config)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.DryRun {
+		config, err := cc.GetConfig(serviceID)
+		if err != nil {
+			return nil, err
+		}
+		result.Version = ConfigVersion(config)
+		result.Config = cc.importConfig(config, values, newSchema, opts.Replace)
+		return result, nil
+	}
+
+	// Values have been validated against the schema read above
+	cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(schemaKey), "=", schemaRevision)}
+	var ops []clientv3.Op
+	if len(result.Schema) > 0 {
+		output, err := json.Marshal(newSchema)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not convert to JSON")
+		}
+		ops = append(ops, clientv3.OpPut(schemaKey, string(output)))
+	}
+	for k, v := range data.Info {
+		ops = append(ops, clientv3.OpPut(cc.serviceKey(serviceID, "info/"+k), v))
+	}
+	unchanged := ""
+	version, err := cc.updateConfigTxn(serviceID, write, func(config map[string]ConfigItem) error {
+		// A changed schema would fail the transaction on every retry
+		resp, err := cc.getKey(schemaKey)
+		if err != nil {
+			return errors.Wrap(err, "Could not retrieve service schema")
+		}
+		var revision int64
+		if len(resp.Kvs) > 0 {
+			revision = resp.Kvs[0].ModRevision
+		}
+		if revision != schemaRevision {
+			return ErrConfigConflict
+		}
+		result.Config = cc.importConfig(config, values, newSchema, opts.Replace)
+		if len(result.Config) == 0 {
+			unchanged = ConfigVersion(config)
+			return errNoChanges
+		}
+		return nil
+	}, func(version string) ([]clientv3.Cmp, []clientv3.Op, error) {
+		return cmps, ops, nil
+	})
+	if err == errNoChanges {
+		version, err = unchanged, nil
+		if len(ops) > 0 {
+			// Only the schema or info changed, the configuration version is kept
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			txn, txnErr := cc.etcd.Txn(ctx).If(cmps...).Then(ops...).Commit()
+			cancel()
+			if txnErr != nil {
+				err = errors.Wrap(txnErr, "Could not write service schema")
+			} else if !txn.Succeeded {
+				err = ErrConfigConflict
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	result.Version = version
+	return result, nil
+}
+
+// importConfig applies the imported values to the configuration and returns the changes with
+// password values decrypted
+func (cc *CCService) importConfig(config map[string]ConfigItem, values map[string]string, schema map[string]SchemaItem, replace bool) []Change {
+	before := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != "v" {
+			before[k] = cc.decryptValue(v.Value)
+		}
+	}
+	now := time.Now().Unix()
+	if replace {
+		for k := range config {
+			if _, ok := values[k]; ok || k == "v" {
+				continue
+			}
+			// Password values may have been excluded from the export, they are only removed together
+			// with their schema entry
+			if item, ok := SchemaItemFor(schema, k); ok && item.Type == TypePassword {
+				continue
+			}
+			delete(config, k)
+		}
+	}
+	for k, v := range values {
+		// Encrypted values differ on every encryption so the plaintext is compared
+		if current, ok := config[k]; ok && cc.decryptValue(current.Value) == cc.decryptValue(v) {
+			continue
+		}
+		config[k] = ConfigItem{Value: v, Changed: now}
+	}
+	after := make(map[string]string, len(config))
+	for k, v := range config {
+		if k != "v" {
+			after[k] = cc.decryptValue(v.Value)
+		}
+	}
+	return DiffValues(before, after)
+}
+
+// schemaValues returns the schema items as JSON for comparison
+func schemaValues(schema map[string]SchemaItem) map[string]string {
+	values := make(map[string]string, len(schema))
+	for k, v := range schema {
+		data, _ := json.Marshal(v)
+		values[k] = string(data)
+	}
+	return values
+}
@@ -0,0 +1,50 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDiffValues(t *testing.T) {
+	before := map[string]string{"same": "1", "changed": "a", "removed": "x"}
+	after := map[string]string{"same": "1", "changed": "b", "added": "y"}
+	assert.Equal(t, []Change{
+		{Key: "added", Action: "added", New: "y"},
+		{Key: "changed", Action: "changed", Old: "a", New: "b"},
+		{Key: "removed", Action: "removed", Old: "x"},
+	}, DiffValues(before, after))
+	assert.Empty(t, DiffValues(before, before))
+}
+
+func TestExportValidate(t *testing.T) {
+	export := NewExport()
+	assert.Error(t, export.Validate())
+	export.Services["service1"] = ServiceExport{}
+	assert.NoError(t, export.Validate())
+	export.Version = 2
+	assert.Error(t, export.Validate())
+}
+
+func TestImportConfigReplace(t *testing.T) {
+	cc := &CCService{}
+	schema := map[string]SchemaItem{"kept": {Type: TypeString}, "secret": {Type: TypePassword}}
+	config := map[string]ConfigItem{
+		"v":      {Value: "3"},
+		"kept":   {Value: "a"},
+		"other":  {Value: "b"},
+		"secret": {Value: "c"},
+		"stale":  {Value: "d"},
+	}
+	changes := cc.importConfig(config, map[string]string{"kept": "a"}, schema, true)
+	assert.Equal(t, []Change{
+		{Key: "other", Action: "removed", Old: "b"},
+		{Key: "stale", Action: "removed", Old: "d"},
+	}, changes)
+	assert.Equal(t, "c", config["secret"].Value)
+
+	// Password values are removed with their schema entry
+	delete(schema, "secret")
+	changes = cc.importConfig(config, map[string]string{"kept": "a"}, schema, true)
+	assert.Equal(t, []Change{{Key: "secret", Action: "removed", Old: "c"}}, changes)
+}
@@ -0,0 +1,81 @@
+package client
+
+import (
+	"encoding/json"
+	"hash/fnv"
+	"math"
+	"strconv"
+
+	"github.com/pkg/errors"
+)
+
+// flagBuckets is the number of buckets subjects are divided into, allows percentages with two decimals
+const flagBuckets = 10000
+
+// Flag is the value of a feature flag, stored as JSON {"percentage": 25, "allow": [...], "deny": [...]}.
+// A plain number is accepted as the percentage.
+type Flag struct {
+	Percentage float64  `json:"percentage"`
+	Allow      []string `json:"allow,omitempty"`
+	Deny       []string `json:"deny,omitempty"`
+}
+
+// ParseFlag decodes a flag value, empty value is a flag which is off for everyone
+func ParseFlag(value string) (*Flag, error) {
+	flag := &Flag{}
+	if value == "" {
+		return flag, nil
+	}
+	if percentage, err := strconv.ParseFloat(value, 64); err == nil {
+		flag.Percentage = percentage
+	} else if err := json.Unmarshal([]byte(value), flag); err != nil {
+		return nil, errors.New(`Flag must be a percentage or JSON such as {"percentage": 25, "allow": ["id"], "deny": ["id"]}`)
+	}
+	// NaN passes the range check but is never within the percentage
+	if math.IsNaN(flag.Percentage) || flag.Percentage < 0 || flag.Percentage > 100 {
+		return nil, errors.Errorf("Flag percentage must be between 0 and 100, got %v", flag.Percentage)
+	}
+	return flag, nil
+}
+
+// Enabled tells if the flag is on for the subject. Subjects in the deny list are always off and subjects
+// in the allow list always on, others are on when their bucket falls within the percentage. The bucket
+// depends only on the flag and the subject so the result is stable and raising the percentage keeps
+// the flag on for subjects which already had it.
+func (f *Flag) Enabled(flagID string, subject string) bool {
+	for _, s := range f.Deny {
+		if s == subject {
+			return false
+		}
+	}
+	for _, s := range f.Allow {
+		if s == subject {
+			return true
+		}
+	}
+	return float64(flagBucket(flagID, subject)) < f.Percentage*flagBuckets/100
+}
+
+// flagBucket returns the bucket of the subject for the flag
+func flagBucket(flagID string, subject string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(flagID + "/" + subject))
+	return h.Sum64() % flagBuckets
+}
+
+// IsEnabled tells if the flag is on for the subject, such as a user ID. The client ID of the instance is
+// used when subject is empty. The flag is off when an error is returned.
+func (s *CCentralService) IsEnabled(flagID string, subject string) (bool, error) {
+	value, err := s.getTypedConfig(flagID, TypeFlag)
+	if err != nil {
+		return false, err
+	}
+	flag, err := ParseFlag(value)
+	if err != nil {
+		return false, errors.Wrapf(err, "Option %v does not contain a valid flag", flagID)
+	}
+	if subject == "" {
+		subject = s.clientID
+	}
+	return flag.Enabled(flagID, subject), nil
+}
@@ -0,0 +1,66 @@
+package client
+
+import (
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFlagEnabled(t *testing.T) {
+	flag, err := ParseFlag(`{"percentage": 100, "deny": ["denied"]}`)
+	assert.NoError(t, err)
+	assert.True(t, flag.Enabled("flag", "anyone"))
+	assert.False(t, flag.Enabled("flag", "denied"))
+
+	flag, err = ParseFlag(`{"percentage": 0, "allow": ["allowed"]}`)
+	assert.NoError(t, err)
+	assert.False(t, flag.Enabled("flag", "anyone"))
+	assert.True(t, flag.Enabled("flag", "allowed"))
+}
+
+func TestFlagPercentage(t *testing.T) {
+	flag, err := ParseFlag("25")
+	assert.NoError(t, err)
+	wider := &Flag{Percentage: 50}
+	on := 0
+	for i := 0; i < 10000; i++ {
+		subject := strconv.Itoa(i)
+		if flag.Enabled("flag", subject) {
+			on++
+			// Raising the percentage keeps the flag on for the same subjects
+			assert.True(t, wider.Enabled("flag", subject))
+		}
+		assert.Equal(t, flag.Enabled("flag", subject), flag.Enabled("flag", subject))
+	}
+	assert.InDelta(t, 2500, on, 200)
+}
+
+func TestIsEnabled(t *testing.T) {
+	api := newMockApi()
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("flag", "", TypeFlag, "Flag", "Flag")
+	service.AddSchema("key", "", TypeString, "Key", "Key")
+	enabled, err := service.IsEnabled("flag", "user")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	api.set("flag", `{"percentage": 0, "allow": ["user"]}`)
+	service.ForceUpdateConfig()
+	enabled, err = service.IsEnabled("flag", "user")
+	assert.NoError(t, err)
+	assert.True(t, enabled)
+	enabled, err = service.IsEnabled("flag", "")
+	assert.NoError(t, err)
+	assert.False(t, enabled)
+
+	_, err = service.IsEnabled("key", "user")
+	assert.Error(t, err)
+}
+
+func TestParseFlagInvalid(t *testing.T) {
+	for _, value := range []string{"NaN", "-1", "101", "+Inf", `{"percentage": 150}`, "on"} {
+		_, err := ParseFlag(value)
+		assert.Error(t, err, value)
+	}
+}
@@ -0,0 +1,207 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// HistoryItem is an immutable record of a single configuration key change
+type HistoryItem struct {
+	Version   int    `json:"version"`
+	Key       string `json:"key"`
+	OldValue  string `json:"old"`
+	NewValue  string `json:"new"`
+	Existed   bool   `json:"existed"`
+	Deleted   bool   `json:"deleted,omitempty"`
+	Timestamp int64  `json:"ts"`
+	Actor     string `json:"actor"`
+}
+
+// ErrInvalidVersion is returned when rolling back to a version that does not exist
+var ErrInvalidVersion = errors.New("Configuration version does not exist")
+
+// historyKey returns the key of a history record, versions are zero padded to keep the keys sorted
+func (cc *CCService) historyKey(serviceID string, version int, keyID string) string {
+	return cc.serviceKey(serviceID, fmt.Sprintf("history/%012d/%s", version, keyID))
+}
+
+// historyOps returns the operations recording every key changed between before and after
+func (cc *CCService) historyOps(serviceID string, before map[string]ConfigItem, after map[string]ConfigItem, actor string) ([]clientv3.Op, error) {
+	version, err := strconv.Atoi(ConfigVersion(after))
+	if err != nil {
+		return nil, errors.Wrap(err, "Invalid configuration version")
+	}
+	now := time.Now().Unix()
+	var ops []clientv3.Op
+	record := func(item HistoryItem) error {
+		item.Version = version
+		item.Timestamp = now
+		item.Actor = actor
+		data, err := json.Marshal(item)
+		if err != nil {
+			return errors.Wrap(err, "Could not convert to JSON")
+		}
+		ops = append(ops, clientv3.OpPut(cc.historyKey(serviceID, version, item.Key), string(data)))
+		return nil
+	}
+	for k, newItem := range after {
+		if k == "v" {
+			continue
+		}
+		oldItem, existed := before[k]
+		if existed && oldItem.Value == newItem.Value {
+			continue
+		}
+		err = record(HistoryItem{Key: k, OldValue: oldItem.Value, NewValue: newItem.Value, Existed: existed})
+		if err != nil {
+			return nil, err
+		}
+	}
+	for k, oldItem := range before {
+		if _, ok := after[k]; ok {
+			continue
+		}
+		err = record(HistoryItem{Key: k, OldValue: oldItem.Value, Existed: true, Deleted: true})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return ops, nil
+}
+
+// GetHistory returns configuration changes newest first. Only versions older than before are returned
+// (all when before is 0). At most limit records are returned (all when limit is 0), the last version of
+// the page is always complete so the next page can be requested with its version.
+func (cc *CCService) GetHistory(serviceID string, before int, limit int) ([]HistoryItem, error) {
+	start := cc.serviceKey(serviceID, "history/")
+	end := clientv3.GetPrefixRangeEnd(start)
+	if before > 0 {
+		end = cc.historyKey(serviceID, before, "")
+	}
+	history, err := cc.readHistory(start, end, limit)
+	if err != nil {
+		return nil, err
+	}
+	if limit > 0 && len(history) == limit {
+		last := history[len(history)-1].Version
+		rest, err := cc.readHistory(cc.historyKey(serviceID, last, ""), cc.historyKey(serviceID, last+1, ""), 0)
+		if err != nil {
+			return nil, err
+		}
+		seen := 0
+		for _, item := range history {
+			if item.Version == last {
+				seen++
+			}
+		}
+		history = append(history, rest[seen:]...)
+	}
+	return history, nil
+}
+
+// readHistory returns history records within the key range [start, end) newest first
+func (cc *CCService) readHistory(start string, end string, limit int) ([]HistoryItem, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := cc.etcd.Get(ctx, start,
+		clientv3.WithRange(end),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortDescend),
+		clientv3.WithLimit(int64(limit)))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get history")
+	}
+	history := make([]HistoryItem, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		item := HistoryItem{}
+		err = json.Unmarshal(kv.Value, &item)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not unmarshal history record "+string(kv.Key))
+		}
+		history = append(history, item)
+	}
+	return history, nil
+}
+
+// RollbackConfig restores the configuration as it was at the given version. The rollback is a change
+// of its own, it increments the version and is recorded into the history.
+func (cc *CCService) RollbackConfig(serviceID string, version int, opts WriteOptions) (string, error) {
+	return cc.updateConfig(serviceID, opts, func(config map[string]ConfigItem) error {
+		return cc.undoHistory(serviceID, config, version)
+	})
+}
+
+// GetConfigAtVersion returns the configuration as it was at the given version
+func (cc *CCService) GetConfigAtVersion(serviceID string, version int) (map[string]ConfigItem, error) {
+	config, err := cc.GetConfig(serviceID)
+	if err != nil {
+		return nil, err
+	}
+	err = cc.undoHistory(serviceID, config, version)
+	if err != nil {
+		return nil, err
+	}
+	config["v"] = ConfigItem{Value: strconv.Itoa(version)}
+	return config, nil
+}
+
+// undoHistory reverts every change made to the configuration after the given version
+func (cc *CCService) undoHistory(serviceID string, config map[string]ConfigItem, version int) error {
+	current, _ := strconv.Atoi(ConfigVersion(config))
+	if version < 0 || version > current {
+		return ErrInvalidVersion
+	}
+	if version < current {
+		first, err := cc.firstRestorableVersion(serviceID, current)
+		if err != nil {
+			return err
+		}
+		if version < first {
+			return errors.Wrap(ErrInvalidVersion, fmt.Sprintf("History starts at version %d", first))
+		}
+	}
+	start := cc.historyKey(serviceID, version+1, "")
+	changes, err := cc.readHistory(start, clientv3.GetPrefixRangeEnd(cc.serviceKey(serviceID, "history/")), 0)
+	if err != nil {
+		return err
+	}
+	// Changes are undone newest first
+	now := time.Now().Unix()
+	for _, change := range changes {
+		if change.Existed {
+			config[change.Key] = ConfigItem{Value: change.OldValue, Changed: now}
+		} else {
+			delete(config, change.Key)
+		}
+	}
+	return nil
+}
+
+// firstRestorableVersion returns the oldest version which can be restored from the history. Changes
+// made before the history was recorded, like those of configurations migrated from etcd v2, can not
+// be undone.
+func (cc *CCService) firstRestorableVersion(serviceID string, current int) (int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := cc.etcd.Get(ctx, cc.serviceKey(serviceID, "history/"),
+		clientv3.WithPrefix(),
+		clientv3.WithSort(clientv3.SortByKey, clientv3.SortAscend),
+		clientv3.WithLimit(1))
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not get history")
+	}
+	if len(resp.Kvs) == 0 {
+		return current, nil
+	}
+	item := HistoryItem{}
+	err = json.Unmarshal(resp.Kvs[0].Value, &item)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not unmarshal history record "+string(resp.Kvs[0].Key))
+	}
+	return item.Version - 1, nil
+}
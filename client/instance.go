@@ -0,0 +1,242 @@
+package client
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// ClientVersion is the version of the Go client library reported by the instances
+const ClientVersion = "0.2.0"
+
+// APIVersion is the CCentral API version reported by the instances
+const APIVersion = "1"
+
+// InstanceInfoPrefix is the prefix for custom instance keys
+const InstanceInfoPrefix = "k_"
+
+// defaultReportInterval is used for the TTL of instances reported without StartReporting
+const defaultReportInterval = time.Minute
+
+// instanceTTLMultiplier defines how many reporting intervals an instance may miss before it expires
+const instanceTTLMultiplier = 3
+
+// instanceLateMultiplier defines after how many reporting intervals without a report an instance is late
+const instanceLateMultiplier = 1.5
+
+// InstanceStatusKey is added to the instance information by GetInstanceList
+const InstanceStatusKey = "status"
+
+// Statuses of a reported instance, see InstanceStatus
+const (
+	// InstanceLive instances have reported within their reporting interval
+	InstanceLive = "live"
+	// InstanceLate instances have missed a report
+	InstanceLate = "late"
+	// InstanceDead instances have missed several reports and have most likely stopped
+	InstanceDead = "dead"
+)
+
+func newClientID() string {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		return strconv.FormatInt(time.Now().UnixNano(), 36)
+	}
+	return hex.EncodeToString(b)
+}
+
+// ClientID returns the generated ID this instance is reported with
+func (s *CCentralService) ClientID() string {
+	return s.clientID
+}
+
+// SetInstanceInfo sets a custom key reported with the instance information (stored with the k_ prefix)
+func (s *CCentralService) SetInstanceInfo(key string, value string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.info[key] = value
+}
+
+// instanceData returns the instance information as stored under clients/CLIENT_ID
+func (s *CCentralService) instanceData() map[string]interface{} {
+	data := s.metrics.data()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	data["v"] = ConfigVersion(s.config)
+	data["cv"] = ClientVersion
+	data["ts"] = time.Now().Unix()
+	data["av"] = APIVersion
+	data["hostname"] = s.hostname
+	data["lv"] = runtime.Version()
+	data["started"] = s.started
+	data["uinterval"] = int64(s.interval / time.Second)
+	for k, v := range s.info {
+		data[InstanceInfoPrefix+k] = v
+	}
+	return data
+}
+
+// numberValue returns the number stored in the instance information, older clients report strings
+func numberValue(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case int64:
+		return float64(v), true
+	case int:
+		return float64(v), true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
+
+// InstanceStatus classifies the instance by the time of its last report (ts) and its reporting interval
+// (uinterval, one minute when not reported). Instances without a timestamp are considered live.
+func InstanceStatus(data map[string]interface{}, now time.Time) string {
+	ts, ok := numberValue(data["ts"])
+	if !ok {
+		return InstanceLive
+	}
+	interval, ok := numberValue(data["uinterval"])
+	if !ok || interval <= 0 {
+		interval = defaultReportInterval.Seconds()
+	}
+	age := float64(now.Unix()) - ts
+	switch {
+	case age > interval*instanceTTLMultiplier:
+		return InstanceDead
+	case age > interval*instanceLateMultiplier:
+		return InstanceLate
+	}
+	return InstanceLive
+}
+
+// RemoveDeadInstances removes the instances of every service in every environment which have not
+// reported for maxAge and are dead. Instances reported with a TTL expire on their own, this removes
+// entries left by clients which do not use one. Returns the number of removed instances.
+func (cc *CCService) RemoveDeadInstances(maxAge time.Duration) (int, error) {
+	envs, err := cc.GetEnvironments()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, env := range envs {
+		n, err := cc.Env(env).(*CCService).removeDeadInstances(maxAge)
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Environment %v", env)
+		}
+	}
+	return count, nil
+}
+
+// removeDeadInstances removes the dead instances of the services in the environment of cc
+func (cc *CCService) removeDeadInstances(maxAge time.Duration) (int, error) {
+	services, err := cc.GetServiceList()
+	if err != nil {
+		return 0, err
+	}
+	now := time.Now()
+	count := 0
+	for _, serviceID := range services.Services {
+		resp, err := cc.getPrefix(cc.serviceKey(serviceID, "clients/"))
+		if err != nil {
+			return count, errors.Wrapf(err, "Could not get instances of %v", serviceID)
+		}
+		for _, kv := range resp.Kvs {
+			data := make(map[string]interface{})
+			if json.Unmarshal(kv.Value, &data) != nil {
+				continue
+			}
+			ts, ok := numberValue(data["ts"])
+			if !ok || InstanceStatus(data, now) != InstanceDead || now.Sub(time.Unix(int64(ts), 0)) < maxAge {
+				continue
+			}
+			// The instance is kept if it reports again while being removed
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			txn, err := cc.etcd.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(string(kv.Key)), "=", kv.ModRevision)).
+				Then(clientv3.OpDelete(string(kv.Key))).
+				Commit()
+			cancel()
+			if err != nil {
+				return count, errors.Wrapf(err, "Could not remove instance of %v", serviceID)
+			}
+			if txn.Succeeded {
+				log.Printf("Removed dead instance %v of %v", lastSegment(kv.Key, cc.serviceKey(serviceID, "clients/")), serviceID)
+				count++
+			}
+		}
+	}
+	return count, nil
+}
+
+// ReportInstance publishes the instance information once
+func (s *CCentralService) ReportInstance() error {
+	api, ok := s.cc.(CCInstanceApi)
+	if !ok {
+		return errors.New("Instance reporting is not supported by the API")
+	}
+	s.mu.RLock()
+	ttl := s.interval * instanceTTLMultiplier
+	s.mu.RUnlock()
+	return api.SetInstance(s.servideID, s.clientID, s.instanceData(), ttl)
+}
+
+// StartReporting publishes the instance information every interval in the background. Instances which
+// stop reporting disappear after a few missed intervals.
+func (s *CCentralService) StartReporting(interval time.Duration) error {
+	if interval < time.Second {
+		return errors.New("Reporting interval must be at least one second")
+	}
+	if _, ok := s.cc.(CCInstanceApi); !ok {
+		return errors.New("Instance reporting is not supported by the API")
+	}
+	s.mu.Lock()
+	if s.stopReport != nil {
+		s.mu.Unlock()
+		return errors.New("Instance is already being reported")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	s.stopReport = cancel
+	s.interval = interval
+	s.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			err := s.ReportInstance()
+			if err != nil {
+				log.Printf("Could not report instance %v of %v: %v", s.clientID, s.servideID, err)
+			}
+			select {
+			case <-ticker.C:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// StopReporting stops publishing the instance information, the entry expires after its TTL
+func (s *CCentralService) StopReporting() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.stopReport != nil {
+		s.stopReport()
+		s.stopReport = nil
+	}
+}
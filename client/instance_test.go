@@ -0,0 +1,19 @@
+package client
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInstanceStatus(t *testing.T) {
+	now := time.Unix(1000, 0)
+	assert.Equal(t, InstanceLive, InstanceStatus(map[string]interface{}{}, now))
+	assert.Equal(t, InstanceLive, InstanceStatus(map[string]interface{}{"ts": float64(990), "uinterval": float64(10)}, now))
+	assert.Equal(t, InstanceLate, InstanceStatus(map[string]interface{}{"ts": float64(980), "uinterval": float64(10)}, now))
+	assert.Equal(t, InstanceDead, InstanceStatus(map[string]interface{}{"ts": float64(960), "uinterval": float64(10)}, now))
+	// Reporting interval defaults to a minute
+	assert.Equal(t, InstanceLive, InstanceStatus(map[string]interface{}{"ts": "960"}, now))
+	assert.Equal(t, InstanceDead, InstanceStatus(map[string]interface{}{"ts": "800"}, now))
+}
@@ -0,0 +1,167 @@
+package client
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// CounterPrefix is the prefix for counter keys in the instance information
+const CounterPrefix = "c_"
+
+// HistogramPrefix is the prefix for histogram keys in the instance information
+const HistogramPrefix = "h_"
+
+// metricWindow is the number of completed minutes kept for each counter
+const metricWindow = 5
+
+// maxHistogramSamples limits the memory used by a single histogram, older samples are replaced at random
+const maxHistogramSamples = 1024
+
+type counter struct {
+	minute  int64
+	current int64
+	history []int64
+}
+
+// rotate moves the counter to the given minute, completed minutes are moved to history
+func (c *counter) rotate(minute int64) {
+	if minute-c.minute > metricWindow {
+		// Everything counted so far is older than the window
+		c.history = c.history[:0]
+		c.current = 0
+		c.minute = minute - metricWindow
+	}
+	for ; c.minute < minute; c.minute++ {
+		c.history = append(c.history, c.current)
+		c.current = 0
+	}
+	if len(c.history) > metricWindow {
+		c.history = c.history[len(c.history)-metricWindow:]
+	}
+}
+
+type histogram struct {
+	minute      int64
+	count       int64
+	samples     []float64
+	percentiles []float64
+}
+
+// rotate moves the histogram to the given minute, percentiles are calculated from the completed minute
+func (h *histogram) rotate(minute int64) {
+	if h.minute == minute {
+		return
+	}
+	if h.minute == minute-1 && len(h.samples) > 0 {
+		h.percentiles = calculatePercentiles(h.samples)
+	} else {
+		h.percentiles = nil
+	}
+	h.minute = minute
+	h.count = 0
+	h.samples = h.samples[:0]
+}
+
+func (h *histogram) observe(value float64) {
+	h.count++
+	if len(h.samples) < maxHistogramSamples {
+		h.samples = append(h.samples, value)
+		return
+	}
+	// Reservoir sampling keeps every observation of the minute equally likely to be included
+	if i := rand.Int63n(h.count); i < maxHistogramSamples {
+		h.samples[i] = value
+	}
+}
+
+// calculatePercentiles returns 75th, 95th, 99th percentiles and the median in the order CCentral expects
+func calculatePercentiles(samples []float64) []float64 {
+	sorted := make([]float64, len(samples))
+	copy(sorted, samples)
+	sort.Float64s(sorted)
+	percentile := func(p float64) float64 {
+		i := int(math.Ceil(p*float64(len(sorted)))) - 1
+		if i < 0 {
+			i = 0
+		}
+		return sorted[i]
+	}
+	return []float64{percentile(0.75), percentile(0.95), percentile(0.99), percentile(0.5)}
+}
+
+type metrics struct {
+	mu         sync.Mutex
+	now        func() time.Time
+	counters   map[string]*counter
+	histograms map[string]*histogram
+}
+
+func newMetrics() *metrics {
+	return &metrics{now: time.Now, counters: make(map[string]*counter), histograms: make(map[string]*histogram)}
+}
+
+func (m *metrics) minute() int64 {
+	return m.now().Unix() / 60
+}
+
+func (m *metrics) incr(name string, n int64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	minute := m.minute()
+	c, ok := m.counters[name]
+	if !ok {
+		c = &counter{minute: minute}
+		m.counters[name] = c
+	}
+	c.rotate(minute)
+	c.current += n
+}
+
+func (m *metrics) observe(name string, value float64) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	minute := m.minute()
+	h, ok := m.histograms[name]
+	if !ok {
+		h = &histogram{minute: minute}
+		m.histograms[name] = h
+	}
+	h.rotate(minute)
+	h.observe(value)
+}
+
+// data returns counters as lists of per-minute counts (oldest first) and histograms as
+// [75th, 95th, 99th, median] lists. Only completed minutes are reported.
+func (m *metrics) data() map[string]interface{} {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	minute := m.minute()
+	data := make(map[string]interface{})
+	for name, c := range m.counters {
+		c.rotate(minute)
+		if len(c.history) > 0 {
+			data[CounterPrefix+name] = append([]int64(nil), c.history...)
+		}
+	}
+	for name, h := range m.histograms {
+		h.rotate(minute)
+		if h.percentiles != nil {
+			data[HistogramPrefix+name] = append([]float64(nil), h.percentiles...)
+		}
+	}
+	return data
+}
+
+// IncrCounter increments the counter by n. Counters are reported as per-minute counts with the instance information.
+func (s *CCentralService) IncrCounter(name string, n int64) {
+	s.metrics.incr(name, n)
+}
+
+// ObserveHistogram records a single value into the histogram. Histograms are reported as percentiles
+// of the previous minute with the instance information.
+func (s *CCentralService) ObserveHistogram(name string, value float64) {
+	s.metrics.observe(name, value)
+}
@@ -0,0 +1,75 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mockClock struct {
+	t time.Time
+}
+
+func (c *mockClock) now() time.Time {
+	return c.t
+}
+
+func newTestMetrics() (*metrics, *mockClock) {
+	clock := &mockClock{t: time.Unix(6000, 0)}
+	m := newMetrics()
+	m.now = clock.now
+	return m, clock
+}
+
+// roundTrip returns the metrics as the plugins see them after reading the instance JSON from etcd
+func roundTrip(t *testing.T, m *metrics) map[string]interface{} {
+	output, err := json.Marshal(m.data())
+	assert.NoError(t, err)
+	data := make(map[string]interface{})
+	assert.NoError(t, json.Unmarshal(output, &data))
+	return data
+}
+
+func TestCounterReportsCompletedMinutes(t *testing.T) {
+	m, clock := newTestMetrics()
+	m.incr("calls", 2)
+	m.incr("calls", 3)
+	assert.Empty(t, m.data())
+	clock.t = clock.t.Add(time.Minute)
+	m.incr("calls", 1)
+	clock.t = clock.t.Add(2 * time.Minute)
+	assert.Equal(t, []int64{5, 1, 0}, m.data()["c_calls"])
+}
+
+func TestCounterKeepsWindow(t *testing.T) {
+	m, clock := newTestMetrics()
+	m.incr("calls", 1)
+	clock.t = clock.t.Add(time.Hour)
+	assert.Equal(t, []int64{0, 0, 0, 0, 0}, m.data()["c_calls"])
+}
+
+// The plugins read this format, see TestCollectClientMetrics of the plugins
+func TestCounterFormat(t *testing.T) {
+	m, clock := newTestMetrics()
+	m.incr("calls", 7)
+	clock.t = clock.t.Add(time.Minute)
+	assert.Equal(t, map[string]interface{}{"c_calls": []interface{}{float64(7)}}, roundTrip(t, m))
+}
+
+func TestHistogramFormat(t *testing.T) {
+	m, clock := newTestMetrics()
+	for i := 1; i <= 100; i++ {
+		m.observe("latency", float64(i))
+	}
+	clock.t = clock.t.Add(time.Minute)
+	assert.Equal(t, map[string]interface{}{"h_latency": []interface{}{float64(75), float64(95), float64(99), float64(50)}}, roundTrip(t, m))
+}
+
+func TestHistogramIsDroppedWhenIdle(t *testing.T) {
+	m, clock := newTestMetrics()
+	m.observe("latency", 1)
+	clock.t = clock.t.Add(2 * time.Minute)
+	assert.Empty(t, m.data())
+}
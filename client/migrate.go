@@ -0,0 +1,61 @@
+package client
+
+import (
+	"context"
+	"log"
+
+	etcdv2 "github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+const v2Root = "/ccentral"
+
+// MigrateFromV2 copies the whole CCentral tree from the etcd v2 store at v2Host into v3 keys.
+// Keys keep their original paths, keys with a TTL (client heartbeats) are attached to a lease
+// with the remaining TTL. Returns the number of copied keys.
+func (cc *CCService) MigrateFromV2(v2Host string) (int, error) {
+	c, err := etcdv2.New(etcdv2.Config{Endpoints: []string{v2Host}})
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not connect to etcd v2")
+	}
+	resp, err := etcdv2.NewKeysAPI(c).Get(context.Background(), v2Root, &etcdv2.GetOptions{Recursive: true})
+	if err != nil {
+		if etcdv2.IsKeyNotFound(err) {
+			log.Printf("Nothing to migrate, %v not found", v2Root)
+			return 0, nil
+		}
+		return 0, errors.Wrap(err, "Could not read etcd v2 tree")
+	}
+	return cc.copyV2Node(resp.Node)
+}
+
+func (cc *CCService) copyV2Node(node *etcdv2.Node) (int, error) {
+	if node.Dir {
+		total := 0
+		for _, child := range node.Nodes {
+			count, err := cc.copyV2Node(child)
+			total += count
+			if err != nil {
+				return total, err
+			}
+		}
+		return total, nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	var opts []clientv3.OpOption
+	if node.TTL > 0 {
+		lease, err := cc.etcd.Grant(ctx, node.TTL)
+		if err != nil {
+			return 0, errors.Wrap(err, "Could not create lease for "+node.Key)
+		}
+		opts = append(opts, clientv3.WithLease(lease.ID))
+	}
+	_, err := cc.etcd.Put(ctx, node.Key, node.Value, opts...)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not write "+node.Key)
+	}
+	log.Printf("Migrated %v", node.Key)
+	return 1, nil
+}
@@ -0,0 +1,155 @@
+package client
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// ErrInvalidSchemaKey is returned for schema keys containing "@", which separates the key of an override
+var ErrInvalidSchemaKey = errors.New("Schema key can not contain @")
+
+// Override scopes in the order of precedence, overrides are stored in the service configuration
+// under KEY@SCOPE:MATCH
+const (
+	// ScopeInstance matches the client ID of the instance
+	ScopeInstance = "instance"
+	// ScopeHost matches the hostname of the instance
+	ScopeHost = "host"
+	// ScopeTag matches a custom instance key, the match is NAME=VALUE without the k_ prefix
+	ScopeTag = "tag"
+)
+
+// Sources of the effective value besides the override scopes
+const (
+	SourceService = "service"
+	SourceDefault = "default"
+)
+
+// Target identifies the instance overrides are resolved for
+type Target struct {
+	ClientID string
+	Hostname string
+	// Tags contains the custom instance keys without the k_ prefix
+	Tags map[string]string
+}
+
+// EffectiveValue is the value an instance uses and the source it came from, either SourceService,
+// SourceDefault or the override as SCOPE:MATCH
+type EffectiveValue struct {
+	Value  string `json:"value"`
+	Source string `json:"source"`
+}
+
+// OverrideKey returns the configuration key of the override of keyID
+func OverrideKey(keyID string, scope string, match string) string {
+	return keyID + "@" + scope + ":" + match
+}
+
+// ParseOverrideKey splits an override key into the overridden key, scope and match. Returns false for
+// keys which are not overrides.
+func ParseOverrideKey(configID string) (keyID string, scope string, match string, ok bool) {
+	i := strings.Index(configID, "@")
+	if i < 0 {
+		return configID, "", "", false
+	}
+	parts := strings.SplitN(configID[i+1:], ":", 2)
+	if len(parts) != 2 {
+		return configID[:i], "", "", false
+	}
+	return configID[:i], parts[0], parts[1], true
+}
+
+// BaseKey returns the key overridden by an override key, other keys are returned as is
+func BaseKey(configID string) string {
+	if i := strings.Index(configID, "@"); i >= 0 {
+		return configID[:i]
+	}
+	return configID
+}
+
+// ValidateSchemaKeys rejects schema keys which would be read as overrides of another key
+func ValidateSchemaKeys(schema map[string]SchemaItem) error {
+	for keyID := range schema {
+		if strings.Contains(keyID, "@") {
+			return errors.Wrap(ErrInvalidSchemaKey, keyID)
+		}
+	}
+	return nil
+}
+
+// SchemaItemFor returns the schema item of the key or of the key an override key overrides
+func SchemaItemFor(schema map[string]SchemaItem, configID string) (SchemaItem, bool) {
+	item, ok := schema[BaseKey(configID)]
+	return item, ok
+}
+
+// validateOverrideKey returns the reason the override key is not valid, empty when it is valid
+func validateOverrideKey(configID string) string {
+	if !strings.Contains(configID, "@") {
+		return ""
+	}
+	_, scope, match, ok := ParseOverrideKey(configID)
+	if !ok || match == "" {
+		return "Override key must be KEY@SCOPE:MATCH"
+	}
+	switch scope {
+	case ScopeInstance, ScopeHost:
+	case ScopeTag:
+		if !strings.Contains(match, "=") {
+			return "Tag override must match NAME=VALUE"
+		}
+	default:
+		return fmt.Sprintf("Unknown override scope %v, expected instance, host or tag", scope)
+	}
+	return ""
+}
+
+// TargetFromInstance returns the target of an instance reported under clients/CLIENT_ID
+func TargetFromInstance(clientID string, data map[string]interface{}) Target {
+	target := Target{ClientID: clientID, Tags: make(map[string]string)}
+	if hostname, ok := data["hostname"].(string); ok {
+		target.Hostname = hostname
+	}
+	for k, v := range data {
+		if strings.HasPrefix(k, InstanceInfoPrefix) {
+			target.Tags[strings.TrimPrefix(k, InstanceInfoPrefix)] = fmt.Sprint(v)
+		}
+	}
+	return target
+}
+
+// Resolve returns the effective value of the key for the target with precedence instance > host >
+// tag > service > schema default. Tags are checked in the order of their names. Empty values are
+// ignored as they fall back to the default.
+func Resolve(schema map[string]SchemaItem, config map[string]ConfigItem, keyID string, target Target) EffectiveValue {
+	candidates := []string{ScopeInstance + ":" + target.ClientID, ScopeHost + ":" + target.Hostname}
+	tags := make([]string, 0, len(target.Tags))
+	for name := range target.Tags {
+		tags = append(tags, name)
+	}
+	sort.Strings(tags)
+	for _, name := range tags {
+		candidates = append(candidates, ScopeTag+":"+name+"="+target.Tags[name])
+	}
+	for _, source := range candidates {
+		if item, ok := config[keyID+"@"+source]; ok && item.Value != "" {
+			return EffectiveValue{Value: item.Value, Source: source}
+		}
+	}
+	if item, ok := config[keyID]; ok && item.Value != "" {
+		return EffectiveValue{Value: item.Value, Source: SourceService}
+	}
+	return EffectiveValue{Value: schema[keyID].Default, Source: SourceDefault}
+}
+
+// ResolveAll returns the effective value of every key of the schema for the target
+func ResolveAll(schema map[string]SchemaItem, config map[string]ConfigItem, target Target) map[string]EffectiveValue {
+	values := make(map[string]EffectiveValue, len(schema))
+	for keyID := range schema {
+		values[keyID] = Resolve(schema, config, keyID, target)
+	}
+	return values
+}
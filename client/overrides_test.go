@@ -0,0 +1,84 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseOverrideKey(t *testing.T) {
+	keyID, scope, match, ok := ParseOverrideKey("log_level@tag:zone=eu-1")
+	assert.True(t, ok)
+	assert.Equal(t, "log_level", keyID)
+	assert.Equal(t, ScopeTag, scope)
+	assert.Equal(t, "zone=eu-1", match)
+	_, _, _, ok = ParseOverrideKey("log_level")
+	assert.False(t, ok)
+	assert.Equal(t, "log_level", BaseKey(OverrideKey("log_level", ScopeHost, "web-1")))
+	assert.Equal(t, "log_level", BaseKey("log_level"))
+}
+
+func TestValidateOverrideKey(t *testing.T) {
+	schema := map[string]SchemaItem{"port": {Type: TypeInteger}}
+	assert.Nil(t, ValidateConfigValues(schema, map[string]string{"port@host:web-1": "8080"}))
+	errs := ValidateConfigValues(schema, map[string]string{
+		"port@host:web-1": "abc",
+		"port@zone:eu":    "1",
+		"port@tag:zone":   "1",
+		"other@host:web":  "1",
+	})
+	assert.Len(t, errs, 4)
+}
+
+func TestResolvePrecedence(t *testing.T) {
+	schema := map[string]SchemaItem{"level": {Default: "info"}}
+	target := Target{ClientID: "abc", Hostname: "web-1", Tags: map[string]string{"zone": "eu", "az": "b"}}
+	config := map[string]ConfigItem{}
+	assert.Equal(t, EffectiveValue{Value: "info", Source: SourceDefault}, Resolve(schema, config, "level", target))
+	config["level"] = ConfigItem{Value: "warn"}
+	assert.Equal(t, EffectiveValue{Value: "warn", Source: SourceService}, Resolve(schema, config, "level", target))
+	config["level@tag:zone=eu"] = ConfigItem{Value: "debug"}
+	config["level@tag:az=b"] = ConfigItem{Value: "error"}
+	assert.Equal(t, EffectiveValue{Value: "error", Source: "tag:az=b"}, Resolve(schema, config, "level", target))
+	config["level@host:web-1"] = ConfigItem{Value: "trace"}
+	assert.Equal(t, EffectiveValue{Value: "trace", Source: "host:web-1"}, Resolve(schema, config, "level", target))
+	config["level@instance:abc"] = ConfigItem{Value: "fatal"}
+	assert.Equal(t, EffectiveValue{Value: "fatal", Source: "instance:abc"}, Resolve(schema, config, "level", target))
+	config["level@instance:abc"] = ConfigItem{Value: ""}
+	assert.Equal(t, "host:web-1", Resolve(schema, config, "level", target).Source)
+	other := Target{ClientID: "def", Hostname: "web-2"}
+	assert.Equal(t, SourceService, Resolve(schema, config, "level", other).Source)
+}
+
+func TestTargetFromInstance(t *testing.T) {
+	target := TargetFromInstance("abc", map[string]interface{}{"hostname": "web-1", "k_zone": "eu", "v": "3"})
+	assert.Equal(t, Target{ClientID: "abc", Hostname: "web-1", Tags: map[string]string{"zone": "eu"}}, target)
+}
+
+func TestGetConfigOverride(t *testing.T) {
+	api := newMockApi()
+	api.set("key", "value")
+	api.set("key@tag:zone=eu", "zone")
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("key", "default", "string", "Key", "Key")
+	service.SetInstanceInfo("zone", "eu")
+	value, err := service.GetConfig("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "zone", value)
+
+	api.set(OverrideKey("key", ScopeInstance, service.ClientID()), "instance")
+	service.ForceUpdateConfig()
+	value, err = service.GetConfig("key")
+	assert.NoError(t, err)
+	assert.Equal(t, "instance", value)
+}
+
+func TestSchemaKeyWithAt(t *testing.T) {
+	assert.NoError(t, ValidateSchemaKeys(map[string]SchemaItem{"port": {}}))
+	assert.Equal(t, ErrInvalidSchemaKey, errors.Cause(ValidateSchemaKeys(map[string]SchemaItem{"port@host": {}})))
+
+	service := InitCCentralService(newMockApi(), "service1")
+	service.AddSchema("port@host", "1", "integer", "Port", "Port")
+	assert.Empty(t, service.schemaCopy())
+}
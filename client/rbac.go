@@ -0,0 +1,123 @@
+package client
+
+import (
+	"encoding/json"
+	"path"
+
+	"github.com/pkg/errors"
+)
+
+const rbacKey = "/ccentral/rbac"
+
+// Access levels granted by the RBAC policy, higher levels include the lower ones
+const (
+	AccessNone = iota
+	AccessRead
+	AccessWrite
+	AccessAdmin
+)
+
+var accessLevels = map[string]int{"read": AccessRead, "write": AccessWrite, "admin": AccessAdmin}
+
+// Grant gives access to services (and optionally keys) matching the glob patterns
+type Grant struct {
+	Services string `json:"services"`
+	Keys     string `json:"keys,omitempty"`
+	Access   string `json:"access"`
+}
+
+// Policy maps users to roles and roles to grants. Users without a binding get the Default roles.
+type Policy struct {
+	Roles   map[string][]Grant  `json:"roles"`
+	Users   map[string][]string `json:"users"`
+	Default []string            `json:"default,omitempty"`
+}
+
+// Validate checks that the policy can be evaluated
+func (p *Policy) Validate() error {
+	for role, grants := range p.Roles {
+		for _, g := range grants {
+			if _, ok := accessLevels[g.Access]; !ok {
+				return errors.Errorf("Role %v has unknown access %v, expected read, write or admin", role, g.Access)
+			}
+			if _, err := path.Match(g.Services, ""); err != nil {
+				return errors.Errorf("Role %v has invalid services pattern %v", role, g.Services)
+			}
+			if _, err := path.Match(g.Keys, ""); err != nil {
+				return errors.Errorf("Role %v has invalid keys pattern %v", role, g.Keys)
+			}
+		}
+	}
+	for user, roles := range p.Users {
+		for _, role := range roles {
+			if _, ok := p.Roles[role]; !ok {
+				return errors.Errorf("User %v has unknown role %v", user, role)
+			}
+		}
+	}
+	return nil
+}
+
+// Access returns the access level of the user to the key of the service. Empty keyID returns the
+// access to the service itself, ignoring key patterns. "*" as the service or key only matches grants of
+// every service or key.
+func (p *Policy) Access(user string, serviceID string, keyID string) int {
+	roles, ok := p.Users[user]
+	if !ok {
+		roles = p.Default
+	}
+	level := AccessNone
+	for _, role := range roles {
+		for _, g := range p.Roles[role] {
+			if !grantMatches(g.Services, serviceID) {
+				continue
+			}
+			if keyID != "" && g.Keys != "" && !grantMatches(g.Keys, keyID) {
+				continue
+			}
+			if accessLevels[g.Access] > level {
+				level = accessLevels[g.Access]
+			}
+		}
+	}
+	return level
+}
+
+// grantMatches reports whether the pattern of a grant matches the name, "*" is only matched by "*"
+func grantMatches(pattern string, name string) bool {
+	if name == "*" {
+		return pattern == "*"
+	}
+	ok, _ := path.Match(pattern, name)
+	return ok
+}
+
+// GetPolicy returns the RBAC policy, nil when no policy has been stored
+func (cc *CCService) GetPolicy() (*Policy, error) {
+	resp, err := cc.getKey(rbacKey)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get RBAC policy")
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	policy := &Policy{}
+	err = json.Unmarshal(resp.Kvs[0].Value, policy)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not unmarshal RBAC policy")
+	}
+	return policy, nil
+}
+
+// SetPolicy validates and stores the RBAC policy
+func (cc *CCService) SetPolicy(policy *Policy) error {
+	err := policy.Validate()
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return errors.Wrap(err, "Could not convert to JSON")
+	}
+	return cc.putKey(rbacKey, string(data))
+}
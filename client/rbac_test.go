@@ -0,0 +1,49 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testPolicy() *Policy {
+	return &Policy{
+		Roles: map[string][]Grant{
+			"viewer":    {{Services: "*", Access: "read"}},
+			"developer": {{Services: "*", Access: "read"}, {Services: "team-*", Access: "write"}, {Services: "ccentral", Keys: "zabbix_*", Access: "write"}},
+			"ops":       {{Services: "*", Access: "admin"}},
+		},
+		Users:   map[string][]string{"alice": {"developer"}, "bob": {"ops"}},
+		Default: []string{"viewer"},
+	}
+}
+
+func TestPolicyAccess(t *testing.T) {
+	p := testPolicy()
+	assert.NoError(t, p.Validate())
+	assert.Equal(t, AccessWrite, p.Access("alice", "team-a", "key"))
+	assert.Equal(t, AccessRead, p.Access("alice", "other", "key"))
+	assert.Equal(t, AccessWrite, p.Access("alice", "ccentral", "zabbix_host"))
+	assert.Equal(t, AccessRead, p.Access("alice", "ccentral", "prometheus_enabled"))
+	assert.Equal(t, AccessWrite, p.Access("alice", "ccentral", ""))
+	assert.Equal(t, AccessAdmin, p.Access("bob", "ccentral", "prometheus_enabled"))
+	assert.Equal(t, AccessRead, p.Access("anonymous", "team-a", "key"))
+	// Access to every key or service requires a grant of every key or service
+	assert.Equal(t, AccessRead, p.Access("alice", "ccentral", "*"))
+	assert.Equal(t, AccessWrite, p.Access("alice", "team-a", "*"))
+	assert.Equal(t, AccessRead, p.Access("alice", "*", "*"))
+	assert.Equal(t, AccessAdmin, p.Access("bob", "*", "*"))
+	p.Roles["keys"] = []Grant{{Services: "*", Keys: "foo_*", Access: "admin"}}
+	p.Users["carol"] = []string{"keys"}
+	assert.Equal(t, AccessAdmin, p.Access("carol", "*", ""))
+	assert.Equal(t, AccessNone, p.Access("carol", "*", "*"))
+}
+
+func TestPolicyValidate(t *testing.T) {
+	p := testPolicy()
+	p.Users["carol"] = []string{"unknown"}
+	assert.Error(t, p.Validate())
+	p = testPolicy()
+	p.Roles["broken"] = []Grant{{Services: "*", Access: "everything"}}
+	assert.Error(t, p.Validate())
+}
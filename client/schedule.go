@@ -0,0 +1,398 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/clientv3/concurrency"
+	"github.com/pkg/errors"
+)
+
+const schedulePrefix = "/ccentral/schedule/"
+
+// scheduleChangesPrefix contains the scheduled changes of every environment
+const scheduleChangesPrefix = schedulePrefix + "changes/"
+
+// scheduleLeaderPrefix is the election prefix of the ccentrald replica running the scheduled changes
+const scheduleLeaderPrefix = schedulePrefix + "leader"
+
+// schedulerTTL is the number of seconds after which another replica takes over from a leader which died
+const schedulerTTL = 15
+
+// scheduleRetention is how long finished changes are listed before the scheduler removes them
+const scheduleRetention = 7 * 24 * time.Hour
+
+// Statuses of a scheduled change
+const (
+	// SchedulePending changes are applied at ApplyAt
+	SchedulePending = "pending"
+	// ScheduleApplied changes are reverted at RevertAt
+	ScheduleApplied = "applied"
+	// ScheduleDone changes have been applied and are not reverted
+	ScheduleDone = "done"
+	// ScheduleReverted changes have been applied and reverted
+	ScheduleReverted = "reverted"
+	// ScheduleFailed changes could not be applied, see Error
+	ScheduleFailed = "failed"
+)
+
+// ScheduledChange is a set of configuration values written at a later time and optionally reverted
+// after a while. Password values are stored encrypted when a keyring has been set.
+type ScheduledChange struct {
+	ID      string            `json:"id"`
+	Env     string            `json:"env"`
+	Service string            `json:"service"`
+	Values  map[string]string `json:"values"`
+	ApplyAt int64             `json:"apply_at"`
+	// RevertAfter is the number of seconds the values are kept before the replaced values are restored,
+	// 0 keeps the values
+	RevertAfter int64  `json:"revert_after,omitempty"`
+	Actor       string `json:"actor"`
+	Created     int64  `json:"created"`
+	Updated     int64  `json:"updated"`
+	Status      string `json:"status"`
+	// Previous contains the values replaced by the change once it has been applied, empty when the key
+	// was not set
+	Previous map[string]string `json:"previous,omitempty"`
+	RevertAt int64             `json:"revert_at,omitempty"`
+	Version  string            `json:"version,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
+
+func scheduledChangeKey(changeID string) string {
+	return scheduleChangesPrefix + changeID
+}
+
+// finished tells if the scheduler has nothing left to do for the change
+func (c *ScheduledChange) finished() bool {
+	return c.Status == ScheduleDone || c.Status == ScheduleReverted || c.Status == ScheduleFailed
+}
+
+// ScheduleChange stores the change to be applied to the service at change.ApplyAt by the scheduler, see
+// RunScheduler. The values should have been validated against the schema, they are validated again
+// when the change is applied.
+func (cc *CCService) ScheduleChange(serviceID string, change ScheduledChange) (*ScheduledChange, error) {
+	if len(change.Values) == 0 {
+		return nil, errors.New("No values given")
+	}
+	values, err := cc.encryptValues(serviceID, change.Values)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	change.ID = newClientID()
+	change.Env = cc.EnvName()
+	change.Service = serviceID
+	change.Values = values
+	change.Created = now
+	change.Updated = now
+	change.Status = SchedulePending
+	data, err := json.Marshal(change)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not convert to JSON")
+	}
+	err = cc.putKey(scheduledChangeKey(change.ID), string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not store scheduled change")
+	}
+	return &change, nil
+}
+
+// GetScheduledChanges returns the scheduled changes of the service ordered by the time they are applied
+func (cc *CCService) GetScheduledChanges(serviceID string) ([]ScheduledChange, error) {
+	resp, err := cc.getPrefix(scheduleChangesPrefix)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get scheduled changes")
+	}
+	changes := make([]ScheduledChange, 0)
+	for _, kv := range resp.Kvs {
+		change := ScheduledChange{}
+		err = json.Unmarshal(kv.Value, &change)
+		if err != nil {
+			return nil, errors.Wrap(err, "Could not unmarshal scheduled change "+string(kv.Key))
+		}
+		if change.Env == cc.EnvName() && change.Service == serviceID {
+			changes = append(changes, change)
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].ApplyAt < changes[j].ApplyAt })
+	return changes, nil
+}
+
+// CancelScheduledChange removes the scheduled change of the service. A change which has already been
+// applied keeps its values and is no longer reverted.
+func (cc *CCService) CancelScheduledChange(serviceID string, changeID string) (*ScheduledChange, error) {
+	key := scheduledChangeKey(changeID)
+	resp, err := cc.getKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not get scheduled change")
+	}
+	change := ScheduledChange{}
+	if len(resp.Kvs) == 0 || json.Unmarshal(resp.Kvs[0].Value, &change) != nil ||
+		change.Env != cc.EnvName() || change.Service != serviceID {
+		return nil, errors.Errorf("Scheduled change %v of %v not found", changeID, serviceID)
+	}
+	err = cc.deleteKey(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not cancel scheduled change")
+	}
+	return &change, nil
+}
+
+// RunScheduler applies and reverts scheduled changes of every environment every interval until the
+// context is cancelled. When several ccentrald replicas run the scheduler only the elected leader
+// applies changes, another replica takes over when the leader stops. notify is called with every
+// change the scheduler has applied, reverted or failed to apply.
+func (cc *CCService) RunScheduler(ctx context.Context, interval time.Duration, notify func(ScheduledChange)) {
+	for ctx.Err() == nil {
+		err := cc.leadScheduler(ctx, interval, notify)
+		if err != nil {
+			log.Printf("Scheduler stopped, restarting: %v", err)
+			select {
+			case <-time.After(interval):
+			case <-ctx.Done():
+			}
+		}
+	}
+}
+
+// leadScheduler waits until elected as the leader and runs the scheduled changes while leading
+func (cc *CCService) leadScheduler(ctx context.Context, interval time.Duration, notify func(ScheduledChange)) error {
+	session, err := concurrency.NewSession(cc.etcd, concurrency.WithTTL(schedulerTTL))
+	if err != nil {
+		return errors.Wrap(err, "Could not create scheduler session")
+	}
+	defer session.Close()
+	hostname, _ := os.Hostname()
+	err = concurrency.NewElection(session, scheduleLeaderPrefix).Campaign(ctx, hostname)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil
+		}
+		return errors.Wrap(err, "Could not campaign for scheduler leadership")
+	}
+	log.Printf("Elected as the scheduler leader")
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		err = cc.runScheduledChanges(time.Now(), notify)
+		if err != nil {
+			log.Printf("Could not run scheduled changes: %v", err)
+		}
+		select {
+		case <-ticker.C:
+		case <-session.Done():
+			return errors.New("Scheduler leadership lost")
+		case <-ctx.Done():
+			return nil
+		}
+	}
+}
+
+// runScheduledChanges applies and reverts the changes which are due and removes old finished changes
+func (cc *CCService) runScheduledChanges(now time.Time, notify func(ScheduledChange)) error {
+	resp, err := cc.getPrefix(scheduleChangesPrefix)
+	if err != nil {
+		return errors.Wrap(err, "Could not get scheduled changes")
+	}
+	for _, kv := range resp.Kvs {
+		change := ScheduledChange{}
+		err = json.Unmarshal(kv.Value, &change)
+		if err != nil {
+			log.Printf("Could not unmarshal scheduled change %v: %v", string(kv.Key), err)
+			continue
+		}
+		env := cc.Env(change.Env).(*CCService)
+		switch {
+		case change.Status == SchedulePending && change.ApplyAt <= now.Unix():
+			err = env.applyScheduledChange(&change, kv.ModRevision, now)
+		case change.Status == ScheduleApplied && change.RevertAt <= now.Unix():
+			err = env.revertScheduledChange(&change, kv.ModRevision, now)
+		case change.finished() && now.Sub(time.Unix(change.Updated, 0)) > scheduleRetention:
+			err = cc.deleteKey(string(kv.Key))
+			if err != nil {
+				log.Printf("Could not remove scheduled change %v: %v", change.ID, err)
+			}
+			continue
+		default:
+			continue
+		}
+		if errors.Cause(err) == errScheduledChangeModified {
+			log.Printf("Scheduled change %v of %v was cancelled while running", change.ID, change.Service)
+			continue
+		}
+		if err != nil {
+			// Writes are retried on the next run
+			log.Printf("Could not run scheduled change %v of %v: %v", change.ID, change.Service, err)
+			continue
+		}
+		notify(change)
+	}
+	return nil
+}
+
+// applyValues writes the values into the configuration and returns the values they replaced, empty
+// when the key was not set
+func applyValues(config map[string]ConfigItem, values map[string]string, now int64) map[string]string {
+	previous := make(map[string]string, len(values))
+	for keyID, value := range values {
+		previous[keyID] = config[keyID].Value
+		config[keyID] = ConfigItem{Value: value, Changed: now}
+	}
+	return previous
+}
+
+// revertValues restores the values replaced by the change. Keys which have been changed after the
+// change was applied are left as they are.
+func revertValues(config map[string]ConfigItem, change *ScheduledChange, now int64) {
+	for keyID, value := range change.Previous {
+		if config[keyID].Value != change.Values[keyID] {
+			continue
+		}
+		if value == "" {
+			delete(config, keyID)
+		} else {
+			config[keyID] = ConfigItem{Value: value, Changed: now}
+		}
+	}
+}
+
+// applied marks the change as applied at version, changes without RevertAfter are done
+func (c *ScheduledChange) applied(values map[string]string, previous map[string]string, version string, now int64) {
+	c.Values = values
+	c.Previous = previous
+	c.Version = version
+	c.Updated = now
+	c.Status = ScheduleDone
+	if c.RevertAfter > 0 {
+		c.Status = ScheduleApplied
+		c.RevertAt = now + c.RevertAfter
+	}
+}
+
+// reverted marks the change as reverted at version
+func (c *ScheduledChange) reverted(version string, now int64) {
+	c.Version = version
+	c.Updated = now
+	c.Status = ScheduleReverted
+}
+
+// applyScheduledChange writes the values of the change and records the values they replaced, the new
+// status of the change is stored in the same transaction. Changes which are no longer valid for the
+// schema are marked as failed, the returned error is for failed writes.
+func (cc *CCService) applyScheduledChange(change *ScheduledChange, revision int64, now time.Time) error {
+	schema, err := cc.GetSchema(change.Service)
+	if err != nil {
+		change.Updated = now.Unix()
+		change.Status, change.Error = ScheduleFailed, "Could not retrieve service schema"
+		return cc.saveScheduledChange(*change, revision)
+	}
+	plain := make(map[string]string, len(change.Values))
+	for keyID, value := range change.Values {
+		plain[keyID] = cc.decryptValue(value)
+	}
+	if errs := ValidateConfigValues(schema, plain); errs != nil {
+		messages := make([]string, len(errs))
+		for i, e := range errs {
+			messages[i] = e.Error()
+		}
+		change.Updated = now.Unix()
+		change.Status, change.Error = ScheduleFailed, strings.Join(messages, ", ")
+		return cc.saveScheduledChange(*change, revision)
+	}
+	values, err := cc.encryptWithSchema(schema, change.Values)
+	if err != nil {
+		return err
+	}
+	var previous map[string]string
+	updated := *change
+	_, err = cc.updateConfigTxn(change.Service, WriteOptions{Actor: change.Actor + " (scheduled)"}, func(config map[string]ConfigItem) error {
+		// A cancelled change would fail the transaction on every retry
+		if err := cc.checkScheduledChange(change.ID, revision); err != nil {
+			return err
+		}
+		previous = applyValues(config, values, now.Unix())
+		return nil
+	}, func(version string) ([]clientv3.Cmp, []clientv3.Op, error) {
+		updated.applied(values, previous, version, now.Unix())
+		return scheduledChangeTxn(updated, revision)
+	})
+	if err != nil {
+		return err
+	}
+	*change = updated
+	return nil
+}
+
+// revertScheduledChange restores the values replaced by the change, see revertValues. The new status
+// of the change is stored in the same transaction.
+func (cc *CCService) revertScheduledChange(change *ScheduledChange, revision int64, now time.Time) error {
+	updated := *change
+	_, err := cc.updateConfigTxn(change.Service, WriteOptions{Actor: change.Actor + " (scheduled revert)"}, func(config map[string]ConfigItem) error {
+		// A cancelled change would fail the transaction on every retry
+		if err := cc.checkScheduledChange(change.ID, revision); err != nil {
+			return err
+		}
+		revertValues(config, change, now.Unix())
+		return nil
+	}, func(version string) ([]clientv3.Cmp, []clientv3.Op, error) {
+		updated.reverted(version, now.Unix())
+		return scheduledChangeTxn(updated, revision)
+	})
+	if err != nil {
+		return err
+	}
+	*change = updated
+	return nil
+}
+
+// errScheduledChangeModified is returned when the change has been modified or cancelled since it was read
+var errScheduledChangeModified = errors.New("Scheduled change was modified or cancelled")
+
+// checkScheduledChange returns errScheduledChangeModified unless the change is still at the revision
+func (cc *CCService) checkScheduledChange(changeID string, revision int64) error {
+	resp, err := cc.getKey(scheduledChangeKey(changeID))
+	if err != nil {
+		return errors.Wrap(err, "Could not get scheduled change")
+	}
+	if len(resp.Kvs) == 0 || resp.Kvs[0].ModRevision != revision {
+		return errScheduledChangeModified
+	}
+	return nil
+}
+
+// scheduledChangeTxn returns the transaction condition and operation storing the change unless it has
+// been modified or cancelled since it was read at the revision
+func scheduledChangeTxn(change ScheduledChange, revision int64) ([]clientv3.Cmp, []clientv3.Op, error) {
+	data, err := json.Marshal(change)
+	if err != nil {
+		return nil, nil, errors.Wrap(err, "Could not convert to JSON")
+	}
+	key := scheduledChangeKey(change.ID)
+	return []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", revision)},
+		[]clientv3.Op{clientv3.OpPut(key, string(data))}, nil
+}
+
+// saveScheduledChange stores the change, see scheduledChangeTxn
+func (cc *CCService) saveScheduledChange(change ScheduledChange, revision int64) error {
+	cmps, ops, err := scheduledChangeTxn(change, revision)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	resp, err := cc.etcd.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return errors.Wrap(err, "Could not update scheduled change")
+	}
+	if !resp.Succeeded {
+		return errScheduledChangeModified
+	}
+	return nil
+}
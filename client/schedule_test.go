@@ -0,0 +1,49 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestScheduledChangeTransitions(t *testing.T) {
+	config := map[string]ConfigItem{"level": {Value: "info"}, "v": {Value: "3"}}
+	change := &ScheduledChange{Values: map[string]string{"level": "debug", "trace": "1"}, RevertAfter: 60, Status: SchedulePending}
+
+	previous := applyValues(config, change.Values, 100)
+	change.applied(change.Values, previous, "4", 100)
+	assert.Equal(t, ScheduleApplied, change.Status)
+	assert.Equal(t, int64(160), change.RevertAt)
+	assert.Equal(t, map[string]string{"level": "info", "trace": ""}, change.Previous)
+	assert.Equal(t, "debug", config["level"].Value)
+	assert.False(t, change.finished())
+
+	revertValues(config, change, 160)
+	change.reverted("5", 160)
+	assert.Equal(t, ScheduleReverted, change.Status)
+	assert.Equal(t, "5", change.Version)
+	assert.True(t, change.finished())
+	assert.Equal(t, "info", config["level"].Value)
+	_, ok := config["trace"]
+	assert.False(t, ok)
+}
+
+func TestScheduledChangeWithoutRevert(t *testing.T) {
+	change := &ScheduledChange{Values: map[string]string{"level": "debug"}, Status: SchedulePending}
+	change.applied(change.Values, map[string]string{"level": "info"}, "4", 100)
+	assert.Equal(t, ScheduleDone, change.Status)
+	assert.Equal(t, int64(0), change.RevertAt)
+	assert.True(t, change.finished())
+}
+
+func TestRevertSkipsChangedKeys(t *testing.T) {
+	config := map[string]ConfigItem{"level": {Value: "info"}, "port": {Value: "80"}}
+	change := &ScheduledChange{Values: map[string]string{"level": "debug", "port": "8080"}, RevertAfter: 60}
+	change.applied(change.Values, applyValues(config, change.Values, 100), "2", 100)
+
+	// Changed by someone else after the change was applied
+	config["port"] = ConfigItem{Value: "9090", Changed: 120}
+	revertValues(config, change, 160)
+	assert.Equal(t, "info", config["level"].Value)
+	assert.Equal(t, ConfigItem{Value: "9090", Changed: 120}, config["port"])
+}
@@ -0,0 +1,579 @@
+package client
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/coreos/etcd/clientv3"
+	"github.com/pkg/errors"
+)
+
+// encryptedPrefix marks encrypted values, the format is enc:KEY_ID:WRAPPED_DATA_KEY:CIPHERTEXT
+const encryptedPrefix = "enc:"
+
+// Keyring contains the master keys used for envelope encryption of password values. Values are
+// encrypted with a random data key which is encrypted (wrapped) with the primary master key. Older
+// keys are kept for decryption only so that keys can be rotated.
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// ParseKeyring reads "KEY_ID BASE64_KEY" entries separated by newlines or semicolons. Keys must be
+// 32 bytes (AES-256), the first entry is the primary key used for encryption.
+func ParseKeyring(data string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, line := range strings.FieldsFunc(data, func(r rune) bool { return r == '\n' || r == ';' }) {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, errors.New("Expected KEY_ID BASE64_KEY")
+		}
+		keyID := fields[0]
+		if strings.Contains(keyID, ":") {
+			return nil, errors.Errorf("Key ID %v must not contain ':'", keyID)
+		}
+		if _, ok := k.keys[keyID]; ok {
+			return nil, errors.Errorf("Key ID %v is defined more than once", keyID)
+		}
+		key, err := base64.StdEncoding.DecodeString(fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "Key %v is not valid base64", keyID)
+		}
+		if len(key) != 32 {
+			return nil, errors.Errorf("Key %v must be 32 bytes, got %d", keyID, len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		k.keys[keyID] = aead
+		if k.primary == "" {
+			k.primary = keyID
+		}
+	}
+	if k.primary == "" {
+		return nil, errors.New("Keyring does not contain any keys")
+	}
+	return k, nil
+}
+
+// LoadKeyring reads the keyring from a file, see ParseKeyring for the format
+func LoadKeyring(path string) (*Keyring, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not read keyring")
+	}
+	k, err := ParseKeyring(string(data))
+	if err != nil {
+		return nil, errors.Wrap(err, path)
+	}
+	return k, nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not create cipher")
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts the plaintext with a random nonce, the nonce is prepended to the result
+func seal(aead cipher.AEAD, plaintext []byte, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "Could not generate nonce")
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+func unseal(aead cipher.AEAD, data []byte, additionalData []byte) ([]byte, error) {
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext is too short")
+	}
+	return aead.Open(nil, data[:aead.NonceSize()], data[aead.NonceSize():], additionalData)
+}
+
+// IsEncrypted tells if the value has been encrypted with a Keyring
+func IsEncrypted(value string) bool {
+	return strings.HasPrefix(value, encryptedPrefix)
+}
+
+// Encrypt encrypts the value with a new data key wrapped by the primary key
+func (k *Keyring) Encrypt(value string) (string, error) {
+	dataKey := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return "", errors.Wrap(err, "Could not generate data key")
+	}
+	wrapped, err := seal(k.keys[k.primary], dataKey, []byte(k.primary))
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	ciphertext, err := seal(aead, []byte(value), nil)
+	if err != nil {
+		return "", err
+	}
+	return encryptedPrefix + k.primary + ":" + base64.StdEncoding.EncodeToString(wrapped) + ":" +
+		base64.StdEncoding.EncodeToString(ciphertext), nil
+}
+
+// Decrypt returns the plaintext of an encrypted value, values which are not encrypted are returned as is
+func (k *Keyring) Decrypt(value string) (string, error) {
+	if !IsEncrypted(value) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, encryptedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("Encrypted value is malformed")
+	}
+	master, ok := k.keys[parts[0]]
+	if !ok {
+		return "", errors.Errorf("Value has been encrypted with unknown key %v", parts[0])
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "Encrypted value is malformed")
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "Encrypted value is malformed")
+	}
+	dataKey, err := unseal(master, wrapped, []byte(parts[0]))
+	if err != nil {
+		return "", errors.Wrapf(err, "Could not unwrap data key with key %v", parts[0])
+	}
+	aead, err := newAEAD(dataKey)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := unseal(aead, ciphertext, nil)
+	if err != nil {
+		return "", errors.Wrap(err, "Could not decrypt value")
+	}
+	return string(plaintext), nil
+}
+
+// current tells if the value is empty or has already been encrypted with the primary key
+func (k *Keyring) current(value string) bool {
+	return value == "" || strings.HasPrefix(value, encryptedPrefix+k.primary+":")
+}
+
+// reencrypt returns the value encrypted with the primary key, plaintext values are encrypted as well
+func (k *Keyring) reencrypt(value string) (string, error) {
+	plaintext, err := k.Decrypt(value)
+	if err != nil {
+		return "", err
+	}
+	return k.Encrypt(plaintext)
+}
+
+// SetKeyring enables encryption of password values written with SetConfigItem
+func (cc *CCService) SetKeyring(keyring *Keyring) {
+	cc.keyring = keyring
+}
+
+// encryptValue encrypts the value when the key has been declared as a password
+func (cc *CCService) encryptValue(serviceID string, keyID string, value string) (string, error) {
+	values, err := cc.encryptValues(serviceID, map[string]string{keyID: value})
+	if err != nil {
+		return "", err
+	}
+	return values[keyID], nil
+}
+
+// encryptValues returns a copy of the values with the values of password keys encrypted
+func (cc *CCService) encryptValues(serviceID string, values map[string]string) (map[string]string, error) {
+	if cc.keyring == nil {
+		return values, nil
+	}
+	schema, err := cc.GetSchema(serviceID)
+	if err != nil {
+		return nil, errors.Wrap(err, "Could not retrieve service schema")
+	}
+	return cc.encryptWithSchema(schema, values)
+}
+
+// encryptWithSchema returns a copy of the values with plaintext password values encrypted
+func (cc *CCService) encryptWithSchema(schema map[string]SchemaItem, values map[string]string) (map[string]string, error) {
+	if cc.keyring == nil {
+		return values, nil
+	}
+	encrypted := make(map[string]string, len(values))
+	for keyID, value := range values {
+		if value != "" && !IsEncrypted(value) && schema[BaseKey(keyID)].Type == TypePassword {
+			var err error
+			value, err = cc.keyring.Encrypt(value)
+			if err != nil {
+				return nil, err
+			}
+		}
+		encrypted[keyID] = value
+	}
+	return encrypted, nil
+}
+
+// decryptValue returns the plaintext of an encrypted value, the value is returned as is when it is not
+// encrypted or can not be decrypted
+func (cc *CCService) decryptValue(value string) string {
+	if cc.keyring == nil || !IsEncrypted(value) {
+		return value
+	}
+	plaintext, err := cc.keyring.Decrypt(value)
+	if err != nil {
+		return value
+	}
+	return plaintext
+}
+
+// RotateSecrets re-encrypts every password value of every service in every environment, including the
+// history, archived services, scheduled changes and change requests, with the primary key of the
+// keyring. Plaintext password values are encrypted. Returns the number of values re-encrypted.
+func (cc *CCService) RotateSecrets() (int, error) {
+	if cc.keyring == nil {
+		return 0, errors.New("Keyring has not been set")
+	}
+	envs, err := cc.GetEnvironments()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, env := range envs {
+		n, err := cc.Env(env).(*CCService).rotateEnv()
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Environment %v", env)
+		}
+	}
+	n, err := cc.rotatePending()
+	count += n
+	return count, err
+}
+
+// rotateEnv re-encrypts the password values of the services in the environment of cc
+func (cc *CCService) rotateEnv() (int, error) {
+	services, err := cc.GetServiceList()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, serviceID := range services.Services {
+		schema, err := cc.GetSchema(serviceID)
+		if err != nil {
+			log.Printf("Skipping %v: %v", serviceID, err)
+			continue
+		}
+		passwords := passwordKeys(schema)
+		if len(passwords) == 0 {
+			continue
+		}
+		n, err := cc.rotateConfig(serviceID, passwords)
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Could not rotate configuration of %v", serviceID)
+		}
+		n, err = cc.rotateHistory(serviceID, passwords)
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Could not rotate history of %v", serviceID)
+		}
+	}
+	n, err := cc.rotateArchives()
+	count += n
+	return count, err
+}
+
+// rotateConfig re-encrypts the password values of the configuration. The configuration version is
+// not changed as the values stay the same.
+func (cc *CCService) rotateConfig(serviceID string, passwords map[string]bool) (int, error) {
+	key := cc.serviceKey(serviceID, "config")
+	for attempt := 0; attempt < maxConfigRetries; attempt++ {
+		config, revision, err := cc.getConfigRevision(serviceID)
+		if err != nil {
+			return 0, err
+		}
+		count, err := cc.rotateConfigItems(passwords, config)
+		if err != nil {
+			return 0, err
+		}
+		if count == 0 {
+			return 0, nil
+		}
+		output, err := json.Marshal(config)
+		if err != nil {
+			return 0, errors.Wrap(err, "Could not convert to JSON")
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp, err := cc.etcd.Txn(ctx).
+			If(clientv3.Compare(clientv3.ModRevision(key), "=", revision)).
+			Then(clientv3.OpPut(key, string(output))).
+			Commit()
+		cancel()
+		if err != nil {
+			return 0, errors.Wrap(err, "Could not update configuration")
+		}
+		if resp.Succeeded {
+			return count, nil
+		}
+		time.Sleep(time.Duration(attempt+1) * 10 * time.Millisecond)
+	}
+	return 0, ErrConfigConflict
+}
+
+// rotateHistory re-encrypts the password values recorded into the history
+func (cc *CCService) rotateHistory(serviceID string, passwords map[string]bool) (int, error) {
+	return cc.rotateRecords(cc.serviceKey(serviceID, "history/"), func(data []byte) ([]byte, int, error) {
+		return cc.rotateHistoryItem(passwords, data)
+	})
+}
+
+// rotateConfigItems re-encrypts the password values of the configuration in place
+func (cc *CCService) rotateConfigItems(passwords map[string]bool, config map[string]ConfigItem) (int, error) {
+	count := 0
+	for keyID, item := range config {
+		if !passwords[BaseKey(keyID)] || cc.keyring.current(item.Value) {
+			continue
+		}
+		var err error
+		item.Value, err = cc.keyring.reencrypt(item.Value)
+		if err != nil {
+			return count, errors.Wrap(err, keyID)
+		}
+		config[keyID] = item
+		count++
+	}
+	return count, nil
+}
+
+// rotateHistoryItem returns the history record with its password values re-encrypted
+func (cc *CCService) rotateHistoryItem(passwords map[string]bool, data []byte) ([]byte, int, error) {
+	item := HistoryItem{}
+	err := json.Unmarshal(data, &item)
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Could not unmarshal history record")
+	}
+	if !passwords[BaseKey(item.Key)] {
+		return nil, 0, nil
+	}
+	count := 0
+	for _, value := range []*string{&item.OldValue, &item.NewValue} {
+		if cc.keyring.current(*value) {
+			continue
+		}
+		*value, err = cc.keyring.reencrypt(*value)
+		if err != nil {
+			return nil, count, err
+		}
+		count++
+	}
+	if count == 0 {
+		return nil, 0, nil
+	}
+	data, err = json.Marshal(item)
+	return data, count, err
+}
+
+// passwordKeys returns the keys of the password fields of the schema
+func passwordKeys(schema map[string]SchemaItem) map[string]bool {
+	passwords := make(map[string]bool)
+	for keyID, item := range schema {
+		if item.Type == TypePassword {
+			passwords[keyID] = true
+		}
+	}
+	return passwords
+}
+
+// rotateValues re-encrypts the password values of every map in place
+func (cc *CCService) rotateValues(passwords map[string]bool, maps ...map[string]string) (int, error) {
+	count := 0
+	for _, values := range maps {
+		for keyID, value := range values {
+			if !passwords[BaseKey(keyID)] || cc.keyring.current(value) {
+				continue
+			}
+			value, err := cc.keyring.reencrypt(value)
+			if err != nil {
+				return count, errors.Wrap(err, keyID)
+			}
+			values[keyID] = value
+			count++
+		}
+	}
+	return count, nil
+}
+
+// rotateRecords rewrites the records under the prefix with rotate, which returns the new record and
+// the number of values it re-encrypted. Records modified in the meantime are rotated again, records
+// removed in the meantime are skipped. Leases of the records are kept.
+func (cc *CCService) rotateRecords(prefix string, rotate func(data []byte) ([]byte, int, error)) (int, error) {
+	resp, err := cc.getPrefix(prefix)
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not get "+prefix)
+	}
+	count := 0
+	for _, kv := range resp.Kvs {
+		key := string(kv.Key)
+		for attempt := 0; ; attempt++ {
+			data, n, err := rotate(kv.Value)
+			if err != nil {
+				return count, errors.Wrap(err, key)
+			}
+			if n == 0 {
+				break
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+			txn, err := cc.etcd.Txn(ctx).
+				If(clientv3.Compare(clientv3.ModRevision(key), "=", kv.ModRevision)).
+				Then(clientv3.OpPut(key, string(data), clientv3.WithIgnoreLease())).
+				Else(clientv3.OpGet(key)).
+				Commit()
+			cancel()
+			if err != nil {
+				return count, errors.Wrap(err, "Could not update "+key)
+			}
+			if txn.Succeeded {
+				count += n
+				break
+			}
+			kvs := txn.Responses[0].GetResponseRange().Kvs
+			if len(kvs) == 0 {
+				break
+			}
+			if attempt == maxConfigRetries-1 {
+				return count, errors.Wrap(ErrConfigConflict, key)
+			}
+			kv = kvs[0]
+		}
+	}
+	return count, nil
+}
+
+// rotateArchives re-encrypts the password values of the configurations and the history of the
+// archived services in the environment of cc
+func (cc *CCService) rotateArchives() (int, error) {
+	archives, err := cc.GetArchivedServices()
+	if err != nil {
+		return 0, err
+	}
+	count := 0
+	for _, archive := range archives {
+		dir := cc.archiveKey(archive.Service, archive.ID) + "keys/"
+		resp, err := cc.getKey(dir + "schema")
+		if err != nil {
+			return count, errors.Wrap(err, "Could not get archived schema of "+archive.Service)
+		}
+		if len(resp.Kvs) == 0 {
+			continue
+		}
+		schema := make(map[string]SchemaItem)
+		err = json.Unmarshal(resp.Kvs[0].Value, &schema)
+		if err != nil {
+			return count, errors.Wrap(err, "Could not unmarshal archived schema of "+archive.Service)
+		}
+		passwords := passwordKeys(schema)
+		if len(passwords) == 0 {
+			continue
+		}
+		n, err := cc.rotateRecords(dir+"config", func(data []byte) ([]byte, int, error) {
+			config := make(map[string]ConfigItem)
+			if err := json.Unmarshal(data, &config); err != nil {
+				return nil, 0, err
+			}
+			n, err := cc.rotateConfigItems(passwords, config)
+			if err != nil || n == 0 {
+				return nil, n, err
+			}
+			data, err = json.Marshal(config)
+			return data, n, err
+		})
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Could not rotate archived configuration of %v", archive.Service)
+		}
+		n, err = cc.rotateRecords(dir+"history/", func(data []byte) ([]byte, int, error) {
+			return cc.rotateHistoryItem(passwords, data)
+		})
+		count += n
+		if err != nil {
+			return count, errors.Wrapf(err, "Could not rotate archived history of %v", archive.Service)
+		}
+	}
+	return count, nil
+}
+
+// rotatePending re-encrypts the password values of the scheduled changes and change requests of every
+// environment, they are written into the configurations later
+func (cc *CCService) rotatePending() (int, error) {
+	schemas := make(map[string]map[string]bool)
+	passwordsOf := func(env string, serviceID string) (map[string]bool, error) {
+		if passwords, ok := schemas[env+"/"+serviceID]; ok {
+			return passwords, nil
+		}
+		schema, err := cc.Env(env).GetSchema(serviceID)
+		if errors.Cause(err) == ErrServiceNotFound {
+			// Changes of deleted services are never written
+			log.Printf("Skipping %v in %v: %v", serviceID, env, err)
+		} else if err != nil {
+			return nil, err
+		}
+		schemas[env+"/"+serviceID] = passwordKeys(schema)
+		return schemas[env+"/"+serviceID], nil
+	}
+	count, err := cc.rotateRecords(scheduleChangesPrefix, func(data []byte) ([]byte, int, error) {
+		change := ScheduledChange{}
+		if err := json.Unmarshal(data, &change); err != nil {
+			return nil, 0, err
+		}
+		passwords, err := passwordsOf(change.Env, change.Service)
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := cc.rotateValues(passwords, change.Values, change.Previous)
+		if err != nil || n == 0 {
+			return nil, n, err
+		}
+		data, err = json.Marshal(change)
+		return data, n, err
+	})
+	if err != nil {
+		return count, errors.Wrap(err, "Could not rotate scheduled changes")
+	}
+	n, err := cc.rotateRecords(approvalsPrefix, func(data []byte) ([]byte, int, error) {
+		request := ChangeRequest{}
+		if err := json.Unmarshal(data, &request); err != nil {
+			return nil, 0, err
+		}
+		passwords, err := passwordsOf(request.Env, request.Service)
+		if err != nil {
+			return nil, 0, err
+		}
+		n, err := cc.rotateValues(passwords, request.Values, request.Previous)
+		if err != nil || n == 0 {
+			return nil, n, err
+		}
+		data, err = json.Marshal(request)
+		return data, n, err
+	})
+	count += n
+	if err != nil {
+		return count, errors.Wrap(err, "Could not rotate change requests")
+	}
+	return count, nil
+}
@@ -0,0 +1,115 @@
+package client
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	testKey1 = "MDEyMzQ1Njc4OWFiY2RlZjAxMjM0NTY3ODlhYmNkZWY="
+	testKey2 = "ZmVkY2JhOTg3NjU0MzIxMGZlZGNiYTk4NzY1NDMyMTA="
+)
+
+func TestKeyringEncrypt(t *testing.T) {
+	k, err := ParseKeyring("k1 " + testKey1)
+	assert.NoError(t, err)
+	encrypted, err := k.Encrypt("secret")
+	assert.NoError(t, err)
+	assert.True(t, IsEncrypted(encrypted))
+	assert.True(t, strings.HasPrefix(encrypted, "enc:k1:"))
+	assert.NotContains(t, encrypted, "secret")
+	plaintext, err := k.Decrypt(encrypted)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", plaintext)
+	plaintext, err = k.Decrypt("not encrypted")
+	assert.NoError(t, err)
+	assert.Equal(t, "not encrypted", plaintext)
+}
+
+func TestKeyringRotation(t *testing.T) {
+	old, err := ParseKeyring("k1 " + testKey1)
+	assert.NoError(t, err)
+	encrypted, err := old.Encrypt("secret")
+	assert.NoError(t, err)
+
+	k, err := ParseKeyring("# new primary key first\nk2 " + testKey2 + "\nk1 " + testKey1)
+	assert.NoError(t, err)
+	assert.False(t, k.current(encrypted))
+	rotated, err := k.reencrypt(encrypted)
+	assert.NoError(t, err)
+	assert.True(t, k.current(rotated))
+	plaintext, err := k.Decrypt(rotated)
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", plaintext)
+
+	_, err = old.Decrypt(rotated)
+	assert.Error(t, err)
+}
+
+func TestParseKeyringErrors(t *testing.T) {
+	_, err := ParseKeyring("")
+	assert.Error(t, err)
+	_, err = ParseKeyring("k1")
+	assert.Error(t, err)
+	_, err = ParseKeyring("k1 c2hvcnQ=")
+	assert.Error(t, err)
+	_, err = ParseKeyring("k:1 " + testKey1)
+	assert.Error(t, err)
+	_, err = ParseKeyring("k1 " + testKey1 + ";k1 " + testKey2)
+	assert.Error(t, err)
+}
+
+func TestServiceDecryptsPasswords(t *testing.T) {
+	k, err := ParseKeyring("k1 " + testKey1)
+	assert.NoError(t, err)
+	encrypted, err := k.Encrypt("secret")
+	assert.NoError(t, err)
+	api := newMockApi()
+	api.set("password", encrypted)
+	service := InitCCentralService(api, "service1")
+	service.AddSchema("password", "", TypePassword, "Password", "Password")
+
+	_, err = service.GetConfigPassword("password")
+	assert.Error(t, err)
+	service.SetKeyring(k)
+	value, err := service.GetConfigPassword("password")
+	assert.NoError(t, err)
+	assert.Equal(t, "secret", value)
+	api.set("encoding", "enc:utf8")
+	service.AddSchema("encoding", "", TypeString, "Encoding", "Encoding")
+	service.ForceUpdateConfig()
+	value, err = service.GetConfig("encoding")
+	assert.NoError(t, err)
+	assert.Equal(t, "enc:utf8", value)
+}
+
+func TestRotatePendingValues(t *testing.T) {
+	old, err := ParseKeyring("k1 " + testKey1)
+	assert.NoError(t, err)
+	encrypted, err := old.Encrypt("secret")
+	assert.NoError(t, err)
+	k, err := ParseKeyring("k2 " + testKey2 + ";k1 " + testKey1)
+	assert.NoError(t, err)
+	cc := &CCService{keyring: k}
+	passwords := map[string]bool{"password": true}
+
+	values := map[string]string{"password@host:web-1": encrypted, "name": "enc:utf8", "password": ""}
+	previous := map[string]string{"password": encrypted}
+	n, err := cc.rotateValues(passwords, values, previous)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	assert.True(t, strings.HasPrefix(values["password@host:web-1"], "enc:k2:"))
+	assert.True(t, strings.HasPrefix(previous["password"], "enc:k2:"))
+	assert.Equal(t, "enc:utf8", values["name"])
+	assert.Equal(t, "", values["password"])
+
+	data, n, err := cc.rotateHistoryItem(passwords, []byte(`{"version": 2, "key": "password", "old": "`+encrypted+`", "new": ""}`))
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	assert.Contains(t, string(data), `"old":"enc:k2:`)
+	_, n, err = cc.rotateHistoryItem(passwords, data)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n)
+}
@@ -1,21 +1,20 @@
 package client
 
 // TODO: Support for API V.1
-// TODO: Add support for "integer" type
-// TODO: Add support for "float" type
-// TODO: Add support for "list" type
-// TODO: Add support for "boolean" type
-// TODO: Add support for "password" type
 
 import (
 	"context"
 	"encoding/json"
 	"log"
+	"math/rand"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
-	"github.com/coreos/etcd/client"
+	"github.com/coreos/etcd/clientv3"
+	"github.com/coreos/etcd/etcdserver/api/v3rpc/rpctypes"
+	"github.com/coreos/etcd/mvcc/mvccpb"
 	"github.com/pkg/errors"
 )
 
@@ -30,6 +29,14 @@ type SchemaItem struct {
 	Type        string `json:"type"`
 	Title       string `json:"title"`
 	Description string `json:"description"`
+	// Optional constraints, see SchemaOption
+	Min       *float64 `json:"min,omitempty"`
+	Max       *float64 `json:"max,omitempty"`
+	Pattern   string   `json:"pattern,omitempty"`
+	Enum      []string `json:"enum,omitempty"`
+	Required  bool     `json:"required,omitempty"`
+	Multiline bool     `json:"multiline,omitempty"`
+	Protected bool     `json:"protected,omitempty"`
 }
 
 // ConfigItem contains value and timestamp when the value was last changed
@@ -51,9 +58,46 @@ type CCApi interface {
 	InitCCentral(etcdHost string) error
 	GetInstanceList(serviceID string) (map[string]map[string]interface{}, error)
 	SetConfigItem(serviceID string, keyID string, value string) (string, error)
+	SetConfigItemWithOptions(serviceID string, keyID string, value string, opts WriteOptions) (string, error)
+	SetConfigItems(serviceID string, values map[string]string, opts WriteOptions) (string, error)
 	GetSchema(serviceID string) (map[string]SchemaItem, error)
 	SetSchema(serviceID string, schema map[string]SchemaItem) error
 	GetConfig(serviceID string) (map[string]ConfigItem, error)
+	GetHistory(serviceID string, before int, limit int) ([]HistoryItem, error)
+	RollbackConfig(serviceID string, version int, opts WriteOptions) (string, error)
+	DeleteConfigItem(serviceID string, keyID string, opts WriteOptions) (string, error)
+	DeleteSchemaItem(serviceID string, keyID string) error
+	ArchiveService(serviceID string, actor string) (*ArchivedService, error)
+	GetArchivedServices() ([]ArchivedService, error)
+	RestoreService(serviceID string, archiveID string) error
+	ExportService(serviceID string, passwords string) (*ServiceExport, error)
+	ImportService(serviceID string, data ServiceExport, opts ImportOptions, write WriteOptions) (*ImportResult, error)
+	GetDiffSource(serviceID string, version int) (*DiffSource, error)
+	ExportDiffSource(label string, data ServiceExport) *DiffSource
+	Env(env string) CCApi
+	EnvName() string
+	GetEnvironments() ([]string, error)
+	PromoteConfig(serviceID string, target string, keys []string, opts ImportOptions, write WriteOptions) (*ImportResult, error)
+	ScheduleChange(serviceID string, change ScheduledChange) (*ScheduledChange, error)
+	GetScheduledChanges(serviceID string) ([]ScheduledChange, error)
+	CancelScheduledChange(serviceID string, changeID string) (*ScheduledChange, error)
+	RequestChange(serviceID string, values map[string]string, actor string, ttl time.Duration) (*ChangeRequest, error)
+	GetChangeRequests(serviceID string) ([]ChangeRequest, error)
+	ReviewChangeRequest(serviceID string, requestID string, reviewer string, approve bool) (*ChangeRequest, string, error)
+	AddAuditRecord(record AuditRecord) error
+	GetAuditRecords(filter AuditFilter) ([]AuditRecord, error)
+	GetPolicy() (*Policy, error)
+	SetPolicy(policy *Policy) error
+}
+
+// CCWatchApi - Interface for APIs able to push configuration changes as they happen
+type CCWatchApi interface {
+	WatchConfig(ctx context.Context, serviceID string) <-chan map[string]ConfigItem
+}
+
+// CCInstanceApi - Interface for publishing instance information of a running client
+type CCInstanceApi interface {
+	SetInstance(serviceID string, clientID string, data map[string]interface{}, ttl time.Duration) error
 }
 
 type CCInit interface {
@@ -83,9 +127,20 @@ type CCServerReadApi interface {
 
 type CCServerWriteApi interface {
 	SetConfigItem(serviceID string, keyID string, value string) (string, error)
+	SetConfigItemWithOptions(serviceID string, keyID string, value string, opts WriteOptions) (string, error)
+	SetConfigItems(serviceID string, values map[string]string, opts WriteOptions) (string, error)
+	DeleteConfigItem(serviceID string, keyID string, opts WriteOptions) (string, error)
 	SetSchema(serviceID string, schema map[string]SchemaItem) error
 }
 
+// WriteOptions controls how configuration writes are applied
+type WriteOptions struct {
+	// IfVersion rejects the write with ErrVersionMismatch unless the configuration is still at this version
+	IfVersion string
+	// Actor is recorded into the history as the author of the change
+	Actor string
+}
+
 // Service is a container for all service data
 type Service struct {
 	Schema    map[string]SchemaItem             `json:"schema"`
@@ -94,11 +149,40 @@ type Service struct {
 	Info      map[string]string                 `json:"info"`
 }
 
-// CCService - ...
+// CCService - CCApi implementation backed by the etcd v3 API
 type CCService struct {
-	etcd client.KeysAPI
+	etcd    *clientv3.Client
+	keyring *Keyring
+	// env is the environment the service tree belongs to, empty for the default environment
+	env string
+	// leases is shared by every environment of the connection
+	leases *instanceLeases
+}
+
+// instanceLeases contains the lease of every instance reported through the connection so that the
+// heartbeats refresh the same lease instead of granting a new one
+type instanceLeases struct {
+	mu  sync.Mutex
+	ids map[string]instanceLease
 }
 
+type instanceLease struct {
+	id  clientv3.LeaseID
+	ttl time.Duration
+}
+
+// maxConfigRetries is the number of attempts for a configuration write before giving up on conflicts
+const maxConfigRetries = 5
+
+// ErrConfigConflict is returned when configuration could not be written due to concurrent modifications
+var ErrConfigConflict = errors.New("Configuration was modified concurrently, please retry")
+
+// ErrVersionMismatch is returned when WriteOptions.IfVersion does not match the current configuration version
+var ErrVersionMismatch = errors.New("Configuration has been changed since it was loaded")
+
+// requestTimeout limits the duration of a single etcd request
+const requestTimeout = 10 * time.Second
+
 // NewSchemaItem - Represents single entry in schema which contains metadata for ConfigItem
 func NewSchemaItem(defaultValue, itemType, title, description string) *SchemaItem {
 	return &SchemaItem{Default: defaultValue, Type: itemType, Title: title, Description: description}
@@ -109,56 +193,114 @@ func NewConfigItem(value string, changed int64) *ConfigItem {
 	return &ConfigItem{Value: value, Changed: changed}
 }
 
+func (cc *CCService) serviceKey(serviceID string, key string) string {
+	return cc.servicesPrefix() + serviceID + "/" + key
+}
+
+// lastSegment returns the path segment directly below prefix
+func lastSegment(key []byte, prefix string) string {
+	rest := strings.TrimPrefix(string(key), prefix)
+	return strings.SplitN(rest, "/", 2)[0]
+}
+
 // InitCCentral will initialize everything required for CCentral usage
 func (cc *CCService) InitCCentral(etcdHost string) error {
-	var err error
 	log.Printf("Connecting to %s", etcdHost)
-	cfg := client.Config{Endpoints: []string{etcdHost}}
-	e, err := client.New(cfg)
+	cfg := clientv3.Config{Endpoints: strings.Split(etcdHost, ","), DialTimeout: 5 * time.Second}
+	e, err := clientv3.New(cfg)
 	if err != nil {
 		return errors.Wrap(err, "Could not initialize CCentral")
 	}
-	cc.etcd = client.NewKeysAPI(e)
+	cc.etcd = e
+	cc.leases = &instanceLeases{ids: make(map[string]instanceLease)}
 	return nil
 }
 
+// getPrefix returns all keys stored under the prefix
+func (cc *CCService) getPrefix(prefix string, opts ...clientv3.OpOption) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return cc.etcd.Get(ctx, prefix, append(opts, clientv3.WithPrefix())...)
+}
+
+// getKey returns a single key, response contains no kvs if the key does not exist
+func (cc *CCService) getKey(key string) (*clientv3.GetResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	return cc.etcd.Get(ctx, key)
+}
+
+func (cc *CCService) putKey(key string, value string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := cc.etcd.Put(ctx, key, value)
+	return err
+}
+
+func (cc *CCService) deleteKey(key string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	_, err := cc.etcd.Delete(ctx, key)
+	return err
+}
+
+// childSegments returns the distinct path segments directly below the prefix in order. Only the first
+// key of each segment is read, the rest of its keys (like the history of a service) are skipped over.
+func (cc *CCService) childSegments(prefix string) ([]string, error) {
+	end := clientv3.GetPrefixRangeEnd(prefix)
+	segments := make([]string, 0)
+	from := prefix
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp, err := cc.etcd.Get(ctx, from, clientv3.WithRange(end), clientv3.WithKeysOnly(), clientv3.WithLimit(1))
+		cancel()
+		if err != nil {
+			return nil, err
+		}
+		if len(resp.Kvs) == 0 {
+			return segments, nil
+		}
+		segment := lastSegment(resp.Kvs[0].Key, prefix)
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+		// "0" follows "/", the next key after every key of the segment
+		from = prefix + segment + "0"
+	}
+}
+
 // GetServiceList returns list of available services
 func (cc *CCService) GetServiceList() (ServiceList, error) {
-	resp, err := cc.etcd.Get(context.Background(), "/ccentral/services/", nil)
+	services, err := cc.childSegments(cc.servicesPrefix())
 	if err != nil {
 		return ServiceList{}, errors.Wrap(err, "Could not get service list")
 	}
-	response := ServiceList{Services: make([]string, 0, resp.Node.Nodes.Len())}
-	for _, v := range resp.Node.Nodes {
-		keys := strings.Split(v.Key, "/")
-		last := keys[len(keys)-1:][0]
-		response.Services = append(response.Services, last)
-	}
-	return response, nil
+	return ServiceList{Services: services}, nil
 }
 
-// GetInstanceList returns full information of each running service instance
+// GetInstanceList returns full information of each reported service instance, the status key contains
+// the classification of the instance by InstanceStatus
 func (cc *CCService) GetInstanceList(serviceID string) (map[string]map[string]interface{}, error) {
 	instances := make(map[string]map[string]interface{})
-	resp, err := cc.etcd.Get(context.Background(), "/ccentral/services/"+serviceID+"/clients", nil)
+	prefix := cc.serviceKey(serviceID, "clients/")
+	resp, err := cc.getPrefix(prefix)
 	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
-			log.Printf("No instances found for service %v", serviceID)
-			return instances, nil
-		}
 		return nil, errors.Wrap(err, "Could not get instance list")
 	}
+	if len(resp.Kvs) == 0 {
+		log.Printf("No instances found for service %v", serviceID)
+		return instances, nil
+	}
 
-	for _, v := range resp.Node.Nodes {
+	now := time.Now()
+	for _, kv := range resp.Kvs {
 		i := make(map[string]interface{})
-		keys := strings.Split(v.Key, "/")
-		last := keys[len(keys)-1:][0]
-		err = json.Unmarshal([]byte(v.Value), &i)
-
+		err = json.Unmarshal(kv.Value, &i)
 		if err != nil {
-			log.Printf("Could not unmarshal following: %v", v.Value)
+			log.Printf("Could not unmarshal following: %v", string(kv.Value))
 		}
-		instances[last] = i
+		i[InstanceStatusKey] = InstanceStatus(i, now)
+		instances[lastSegment(kv.Key, prefix)] = i
 	}
 	return instances, nil
 }
@@ -175,85 +317,305 @@ func incrementVersion(config map[string]ConfigItem) string {
 	return version.Value
 }
 
+// ConfigVersion returns the version of the configuration, "0" for configuration that has never been written
+func ConfigVersion(config map[string]ConfigItem) string {
+	version, ok := config["v"]
+	if !ok || version.Value == "" {
+		return "0"
+	}
+	return version.Value
+}
+
 // SetConfigItem allows changing the service configuration
 func (cc *CCService) SetConfigItem(serviceID string, keyID string, value string) (string, error) {
-	config, err := cc.GetConfig(serviceID)
+	return cc.SetConfigItemWithOptions(serviceID, keyID, value, WriteOptions{})
+}
+
+// SetConfigItemWithOptions changes the service configuration, see WriteOptions for available conditions.
+// Password values are encrypted when a keyring has been set.
+func (cc *CCService) SetConfigItemWithOptions(serviceID string, keyID string, value string, opts WriteOptions) (string, error) {
+	value, err := cc.encryptValue(serviceID, keyID, value)
 	if err != nil {
-		return "", errors.Wrap(err, "Could not retrieve service configuration")
+		return "", err
 	}
-	config[keyID] = ConfigItem{
-		Value:   value,
-		Changed: time.Now().Unix(),
+	return cc.updateConfig(serviceID, opts, func(config map[string]ConfigItem) error {
+		config[keyID] = ConfigItem{
+			Value:   value,
+			Changed: time.Now().Unix(),
+		}
+		return nil
+	})
+}
+
+// SetConfigItems changes several configuration values atomically with a single version increment,
+// see WriteOptions for available conditions. Password values are encrypted when a keyring has been set.
+func (cc *CCService) SetConfigItems(serviceID string, values map[string]string, opts WriteOptions) (string, error) {
+	values, err := cc.encryptValues(serviceID, values)
+	if err != nil {
+		return "", err
 	}
+	return cc.updateConfig(serviceID, opts, func(config map[string]ConfigItem) error {
+		now := time.Now().Unix()
+		for keyID, value := range values {
+			config[keyID] = ConfigItem{Value: value, Changed: now}
+		}
+		return nil
+	})
+}
 
-	version := incrementVersion(config)
+// updateConfig applies mutate to the current configuration and writes it back only if nobody else
+// has modified the configuration in the meantime. Conflicting writes are retried with a fresh copy
+// of the configuration up to maxConfigRetries times before ErrConfigConflict is returned. Every
+// changed key is recorded into the service history within the same transaction.
+func (cc *CCService) updateConfig(serviceID string, opts WriteOptions, mutate func(config map[string]ConfigItem) error) (string, error) {
+	return cc.updateConfigTxn(serviceID, opts, mutate, nil)
+}
 
-	output, err := json.Marshal(config)
-	if err != nil {
-		return "", errors.Wrap(err, "Could not convert to JSON")
+// updateConfigTxn is updateConfig writing other keys within the same transaction. extra is called with
+// the new version on every attempt and returns the additional conditions and operations, failing
+// conditions are retried like conflicts so mutate should check them first.
+func (cc *CCService) updateConfigTxn(serviceID string, opts WriteOptions, mutate func(config map[string]ConfigItem) error,
+	extra func(version string) ([]clientv3.Cmp, []clientv3.Op, error)) (string, error) {
+	key := cc.serviceKey(serviceID, "config")
+	for attempt := 0; attempt < maxConfigRetries; attempt++ {
+		config, revision, err := cc.getConfigRevision(serviceID)
+		if err != nil {
+			return "", errors.Wrap(err, "Could not retrieve service configuration")
+		}
+		if opts.IfVersion != "" && opts.IfVersion != ConfigVersion(config) {
+			return "", ErrVersionMismatch
+		}
+		before := copyConfig(config)
+		err = mutate(config)
+		if err != nil {
+			return "", err
+		}
+
+		version := incrementVersion(config)
+
+		output, err := json.Marshal(config)
+		if err != nil {
+			return "", errors.Wrap(err, "Could not convert to JSON")
+		}
+		ops := []clientv3.Op{clientv3.OpPut(key, string(output))}
+		historyOps, err := cc.historyOps(serviceID, before, config, opts.Actor)
+		if err != nil {
+			return "", err
+		}
+		ops = append(ops, historyOps...)
+		cmps := []clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", revision)}
+		if extra != nil {
+			extraCmps, extraOps, err := extra(version)
+			if err != nil {
+				return "", err
+			}
+			cmps = append(cmps, extraCmps...)
+			ops = append(ops, extraOps...)
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		resp, err := cc.etcd.Txn(ctx).
+			If(cmps...).
+			Then(ops...).
+			Commit()
+		cancel()
+		if err != nil {
+			return "", errors.Wrap(err, "Could not update configuration")
+		}
+		if resp.Succeeded {
+			return version, nil
+		}
+		log.Printf("Configuration of %v was modified concurrently, retrying (attempt %d)", serviceID, attempt+1)
+		time.Sleep(time.Duration(rand.Intn(20*(attempt+1))) * time.Millisecond)
 	}
+	return "", ErrConfigConflict
+}
 
-	_, err = cc.etcd.Set(context.Background(), "/ccentral/services/"+serviceID+"/config", string(output), nil)
-	if err != nil {
-		return "", errors.Wrap(err, "Could not update configuration")
+func copyConfig(config map[string]ConfigItem) map[string]ConfigItem {
+	c := make(map[string]ConfigItem, len(config))
+	for k, v := range config {
+		c[k] = v
 	}
-	return version, nil
+	return c
 }
 
 // GetSchema returns configuration schema
 func (cc *CCService) GetSchema(serviceID string) (map[string]SchemaItem, error) {
-	resp, err := cc.etcd.Get(context.Background(), "/ccentral/services/"+serviceID+"/schema", nil)
+	resp, err := cc.getKey(cc.serviceKey(serviceID, "schema"))
 	if err != nil {
 		return nil, err
 	}
+	if len(resp.Kvs) == 0 {
+		return nil, errors.Wrap(ErrServiceNotFound, "Schema not found for service "+serviceID)
+	}
 	v := make(map[string]SchemaItem)
-	err = json.Unmarshal([]byte(resp.Node.Value), &v)
+	err = json.Unmarshal(resp.Kvs[0].Value, &v)
 	return v, err
 }
 
-// SetSchema writes the new schema to the etcd
+// SetSchema writes the new schema to the etcd, keys containing "@" are rejected with ErrInvalidSchemaKey
 func (cc *CCService) SetSchema(serviceID string, schema map[string]SchemaItem) error {
+	err := ValidateSchemaKeys(schema)
+	if err != nil {
+		return err
+	}
 	data, err := json.Marshal(schema)
 	if err != nil {
 		return err
 	}
-	_, err = cc.etcd.Set(context.Background(), "/ccentral/services/"+serviceID+"/schema", string(data), nil)
-	return err
+	return cc.putKey(cc.serviceKey(serviceID, "schema"), string(data))
 }
 
 // GetServiceInfoList returns list of service shared service information reported by the clients
 func (cc *CCService) GetServiceInfoList(serviceID string) (map[string]string, error) {
 	info := make(map[string]string)
-	resp, err := cc.etcd.Get(context.Background(), "/ccentral/services/"+serviceID+"/info", nil)
+	prefix := cc.serviceKey(serviceID, "info/")
+	resp, err := cc.getPrefix(prefix)
 	if err != nil {
-		if strings.Contains(err.Error(), "Key not found") {
-			log.Printf("No service info found for service %v", serviceID)
-			return info, nil
-		}
 		return nil, errors.Wrap(err, "Could not get service info list")
 	}
-	for _, v := range resp.Node.Nodes {
-		keys := strings.Split(v.Key, "/")
-		last := keys[len(keys)-1:][0]
-		if err != nil {
-			log.Printf("Could not unmarshal following: %v", v.Value)
-		}
-		info[last] = v.Value
+	if len(resp.Kvs) == 0 {
+		log.Printf("No service info found for service %v", serviceID)
+		return info, nil
+	}
+	for _, kv := range resp.Kvs {
+		info[lastSegment(kv.Key, prefix)] = string(kv.Value)
 	}
 	return info, nil
 }
 
 // GetConfig returns full listing of service configuration
 func (cc *CCService) GetConfig(serviceID string) (map[string]ConfigItem, error) {
+	v, _, err := cc.getConfigRevision(serviceID)
+	return v, err
+}
+
+// getConfigRevision returns the service configuration and the etcd revision it was last modified
+// at. Revision is 0 when the configuration has not been written yet.
+func (cc *CCService) getConfigRevision(serviceID string) (map[string]ConfigItem, int64, error) {
 	v := make(map[string]ConfigItem)
-	resp, err := cc.etcd.Get(context.Background(), "/ccentral/services/"+serviceID+"/config", nil)
+	resp, err := cc.getKey(cc.serviceKey(serviceID, "config"))
+	if err != nil {
+		return nil, 0, errors.Wrap(err, "Configuration could not be loaded")
+	}
+	// Most likely new service that has only schema setup, just ignore the missing configuration
+	if len(resp.Kvs) == 0 {
+		return v, 0, nil
+	}
+	err = json.Unmarshal(resp.Kvs[0].Value, &v)
+	return v, resp.Kvs[0].ModRevision, err
+}
+
+// WatchConfig sends the current service configuration followed by every change made to it until the
+// context is cancelled, after which the channel is closed.
+func (cc *CCService) WatchConfig(ctx context.Context, serviceID string) <-chan map[string]ConfigItem {
+	ch := make(chan map[string]ConfigItem)
+	go cc.watchConfig(ctx, serviceID, ch)
+	return ch
+}
+
+func (cc *CCService) watchConfig(ctx context.Context, serviceID string, ch chan<- map[string]ConfigItem) {
+	defer close(ch)
+	key := cc.serviceKey(serviceID, "config")
+	for ctx.Err() == nil {
+		resp, err := cc.getKey(key)
+		if err != nil {
+			log.Printf("Could not load configuration for %v: %v", serviceID, err)
+			select {
+			case <-time.After(time.Second):
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		config := make(map[string]ConfigItem)
+		if len(resp.Kvs) > 0 {
+			err = json.Unmarshal(resp.Kvs[0].Value, &config)
+			if err != nil {
+				log.Printf("Could not unmarshal configuration for %v: %v", serviceID, err)
+			}
+		}
+		select {
+		case ch <- config:
+		case <-ctx.Done():
+			return
+		}
+		// Watch from the next revision so that nothing is missed between the read and the watch
+		if !cc.watchConfigFrom(ctx, serviceID, resp.Header.Revision+1, ch) {
+			return
+		}
+	}
+}
+
+// watchConfigFrom sends the configuration changes made since the revision until the watch fails.
+// Returns false when the context has been cancelled.
+func (cc *CCService) watchConfigFrom(ctx context.Context, serviceID string, revision int64, ch chan<- map[string]ConfigItem) bool {
+	// The watch stream is closed before the configuration is reloaded
+	wctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	for wresp := range cc.etcd.Watch(wctx, cc.serviceKey(serviceID, "config"), clientv3.WithRev(revision)) {
+		if err := wresp.Err(); err != nil {
+			log.Printf("Configuration watch for %v failed, reloading: %v", serviceID, err)
+			return true
+		}
+		for _, ev := range wresp.Events {
+			config := make(map[string]ConfigItem)
+			if ev.Type == mvccpb.PUT {
+				err := json.Unmarshal(ev.Kv.Value, &config)
+				if err != nil {
+					log.Printf("Could not unmarshal configuration for %v: %v", serviceID, err)
+					continue
+				}
+			}
+			select {
+			case ch <- config:
+			case <-ctx.Done():
+				return false
+			}
+		}
+	}
+	return ctx.Err() == nil
+}
+
+// SetInstance publishes instance information of a running client, the entry expires after ttl unless refreshed
+func (cc *CCService) SetInstance(serviceID string, clientID string, data map[string]interface{}, ttl time.Duration) error {
+	output, err := json.Marshal(data)
+	if err != nil {
+		return errors.Wrap(err, "Could not convert to JSON")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	key := cc.serviceKey(serviceID, "clients/"+clientID)
+	leaseID, err := cc.instanceLease(ctx, key, ttl)
 	if err != nil {
-		// Most likely new service that has only schema setup, just ignore the missing configuration
-		if strings.Contains(err.Error(), "100: Key not found") {
-			return v, nil
+		return err
+	}
+	_, err = cc.etcd.Put(ctx, key, string(output), clientv3.WithLease(leaseID))
+	if err != nil {
+		return errors.Wrap(err, "Could not update instance information")
+	}
+	return nil
+}
+
+// instanceLease returns the lease of the instance key refreshed for another ttl. A new lease is granted
+// on the first report, when the ttl changes and when the previous lease has already expired, replaced
+// leases expire on their own.
+func (cc *CCService) instanceLease(ctx context.Context, key string, ttl time.Duration) (clientv3.LeaseID, error) {
+	cc.leases.mu.Lock()
+	defer cc.leases.mu.Unlock()
+	if lease, ok := cc.leases.ids[key]; ok && lease.ttl == ttl {
+		_, err := cc.etcd.KeepAliveOnce(ctx, lease.id)
+		if err == nil {
+			return lease.id, nil
+		}
+		if err != rpctypes.ErrLeaseNotFound {
+			return 0, errors.Wrap(err, "Could not refresh lease for instance")
 		}
-		return nil, errors.Wrap(err, "Configuration could not be loaded")
 	}
-	err = json.Unmarshal([]byte(resp.Node.Value), &v)
-	return v, err
+	lease, err := cc.etcd.Grant(ctx, int64(ttl/time.Second))
+	if err != nil {
+		return 0, errors.Wrap(err, "Could not create lease for instance")
+	}
+	cc.leases.ids[key] = instanceLease{id: lease.ID, ttl: ttl}
+	return lease.ID, nil
 }
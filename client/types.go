@@ -0,0 +1,44 @@
+package client
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Configuration field types supported in SchemaItem.Type
+const (
+	TypeString   = "string"
+	TypePassword = "password"
+	TypeInteger  = "integer"
+	TypeFloat    = "float"
+	TypeList     = "list"
+	TypeBoolean  = "boolean"
+	TypeDuration = "duration"
+	TypeFlag     = "flag"
+)
+
+// ParseList decodes a list value from its JSON storage format ["field1", "field2"]
+func ParseList(value string) ([]string, error) {
+	var list []string
+	err := json.Unmarshal([]byte(value), &list)
+	if err != nil {
+		return nil, errors.Wrap(err, "List must be a JSON array of strings")
+	}
+	return list, nil
+}
+
+// ParseDuration decodes a duration value, integers are interpreted as seconds
+func ParseDuration(value string) (time.Duration, error) {
+	seconds, err := strconv.ParseInt(value, 10, 64)
+	if err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.Errorf("Duration must be seconds or a duration such as 1m30s, got %q", value)
+	}
+	return d, nil
+}
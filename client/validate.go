@@ -0,0 +1,192 @@
+package client
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// SchemaOption sets an optional constraint on a SchemaItem
+type SchemaOption func(*SchemaItem)
+
+// WithMin sets the smallest allowed value for integer, float and duration (in seconds) fields
+func WithMin(min float64) SchemaOption {
+	return func(i *SchemaItem) {
+		i.Min = &min
+	}
+}
+
+// WithMax sets the largest allowed value for integer, float and duration (in seconds) fields
+func WithMax(max float64) SchemaOption {
+	return func(i *SchemaItem) {
+		i.Max = &max
+	}
+}
+
+// WithPattern sets a regular expression the whole value (or each list item) must match
+func WithPattern(pattern string) SchemaOption {
+	return func(i *SchemaItem) {
+		i.Pattern = pattern
+	}
+}
+
+// WithEnum limits the value (or each list item) to the given values
+func WithEnum(values ...string) SchemaOption {
+	return func(i *SchemaItem) {
+		i.Enum = values
+	}
+}
+
+// WithRequired rejects empty values
+func WithRequired() SchemaOption {
+	return func(i *SchemaItem) {
+		i.Required = true
+	}
+}
+
+// WithMultiline shows the field as a multiline text area in the web UI
+func WithMultiline() SchemaOption {
+	return func(i *SchemaItem) {
+		i.Multiline = true
+	}
+}
+
+// WithProtected requires the approval of a second user for changes of the field
+func WithProtected() SchemaOption {
+	return func(i *SchemaItem) {
+		i.Protected = true
+	}
+}
+
+// ValidationError describes why a value is not valid for a configuration field
+type ValidationError struct {
+	Field   string `json:"field"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string {
+	return e.Field + ": " + e.Message
+}
+
+// ValidateConfigValue checks that the value can be stored into the field described by the schema item.
+// Returns a *ValidationError when the value is not valid. Unknown types accept any value.
+func ValidateConfigValue(keyID string, item SchemaItem, value string) error {
+	invalid := func(message string) error {
+		return &ValidationError{Field: keyID, Message: message}
+	}
+	if value == "" {
+		if item.Required {
+			return invalid("Value is required")
+		}
+		// Empty value falls back to the default
+		return nil
+	}
+	items := []string{value}
+	switch item.Type {
+	case TypeInteger:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return invalid("Value must be an integer")
+		}
+		if message := checkRange(item, float64(i)); message != "" {
+			return invalid(message)
+		}
+	case TypeFloat:
+		f, err := strconv.ParseFloat(value, 64)
+		// NaN would pass any range check
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return invalid("Value must be a number")
+		}
+		if message := checkRange(item, f); message != "" {
+			return invalid(message)
+		}
+	case TypeBoolean:
+		if value != "1" && value != "0" {
+			return invalid("Value must be 1 or 0")
+		}
+	case TypeList:
+		list, err := ParseList(value)
+		if err != nil {
+			return invalid(`Value must be a JSON array of strings, for example ["a", "b"]`)
+		}
+		items = list
+	case TypeFlag:
+		if _, err := ParseFlag(value); err != nil {
+			return invalid(err.Error())
+		}
+	case TypeDuration:
+		d, err := ParseDuration(value)
+		if err != nil {
+			return invalid(err.Error())
+		}
+		if message := checkRange(item, d.Seconds()); message != "" {
+			return invalid(message)
+		}
+	}
+	for _, v := range items {
+		if message := checkPatternAndEnum(item, v); message != "" {
+			return invalid(message)
+		}
+	}
+	return nil
+}
+
+// ValidateConfigValues validates every value (or override) against the schema, keys missing from the
+// schema are rejected. Returns all validation errors ordered by key, nil when every value is valid.
+func ValidateConfigValues(schema map[string]SchemaItem, values map[string]string) []*ValidationError {
+	var errs []*ValidationError
+	for keyID, value := range values {
+		if message := validateOverrideKey(keyID); message != "" {
+			errs = append(errs, &ValidationError{Field: keyID, Message: message})
+			continue
+		}
+		item, ok := SchemaItemFor(schema, keyID)
+		if !ok {
+			errs = append(errs, &ValidationError{Field: keyID, Message: "Unknown configuration key"})
+			continue
+		}
+		if err, ok := ValidateConfigValue(keyID, item, value).(*ValidationError); ok {
+			errs = append(errs, err)
+		}
+	}
+	sort.Slice(errs, func(i, j int) bool { return errs[i].Field < errs[j].Field })
+	return errs
+}
+
+func checkRange(item SchemaItem, value float64) string {
+	if item.Min != nil && value < *item.Min {
+		return fmt.Sprintf("Value must be at least %v", *item.Min)
+	}
+	if item.Max != nil && value > *item.Max {
+		return fmt.Sprintf("Value must be at most %v", *item.Max)
+	}
+	return ""
+}
+
+func checkPatternAndEnum(item SchemaItem, value string) string {
+	quoted := fmt.Sprintf("%q", value)
+	// Secrets must not end up in responses or logs
+	if item.Type == TypePassword {
+		quoted = "******"
+	}
+	if item.Pattern != "" {
+		re, err := regexp.Compile("^(?:" + item.Pattern + ")$")
+		if err != nil {
+			return "Schema contains an invalid pattern " + item.Pattern
+		}
+		if !re.MatchString(value) {
+			return fmt.Sprintf("Value %v does not match pattern %v", quoted, item.Pattern)
+		}
+	}
+	if len(item.Enum) > 0 {
+		for _, allowed := range item.Enum {
+			if value == allowed {
+				return ""
+			}
+		}
+		return fmt.Sprintf("Value %v is not one of the allowed values %v", quoted, item.Enum)
+	}
+	return ""
+}
@@ -0,0 +1,111 @@
+package client
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestValidateConfigValue(t *testing.T) {
+	cases := []struct {
+		valueType string
+		value     string
+		valid     bool
+	}{
+		{TypeString, "anything", true},
+		{TypePassword, "anything", true},
+		{TypeInteger, "42", true},
+		{TypeInteger, "-1", true},
+		{TypeInteger, "abc", false},
+		{TypeInteger, "1.5", false},
+		{TypeFloat, "1.5", true},
+		{TypeFloat, "abc", false},
+		{TypeFloat, "NaN", false},
+		{TypeFloat, "+Inf", false},
+		{TypeBoolean, "1", true},
+		{TypeBoolean, "0", true},
+		{TypeBoolean, "true", false},
+		{TypeList, `["a", "b"]`, true},
+		{TypeList, `[]`, true},
+		{TypeList, `[1, 2]`, false},
+		{TypeList, `a, b`, false},
+		{TypeFlag, "25", true},
+		{TypeFlag, `{"percentage": 10, "allow": ["a"]}`, true},
+		{TypeFlag, "101", false},
+		{TypeFlag, "on", false},
+		{TypeDuration, "30", true},
+		{TypeDuration, "1m30s", true},
+		{TypeDuration, "soon", false},
+		{"custom", "anything", true},
+	}
+	for _, c := range cases {
+		err := ValidateConfigValue("key", SchemaItem{Type: c.valueType}, c.value)
+		if c.valid {
+			assert.NoError(t, err, "%v %q", c.valueType, c.value)
+		} else {
+			assert.IsType(t, &ValidationError{}, err, "%v %q", c.valueType, c.value)
+		}
+	}
+}
+
+func TestValidateConstraints(t *testing.T) {
+	port := SchemaItem{Type: TypeInteger}
+	WithMin(1)(&port)
+	WithMax(65535)(&port)
+	mode := SchemaItem{Type: TypeString}
+	WithEnum("a", "b", "c")(&mode)
+	WithRequired()(&mode)
+	modes := SchemaItem{Type: TypeList}
+	WithEnum("a", "b")(&modes)
+	name := SchemaItem{Type: TypeString}
+	WithPattern("[a-z]+")(&name)
+	timeout := SchemaItem{Type: TypeDuration}
+	WithMax(60)(&timeout)
+	ratio := SchemaItem{Type: TypeFloat}
+	WithMin(0)(&ratio)
+	WithMax(1)(&ratio)
+
+	assert.NoError(t, ValidateConfigValue("port", port, "8080"))
+	assert.EqualError(t, ValidateConfigValue("port", port, "0"), "port: Value must be at least 1")
+	assert.EqualError(t, ValidateConfigValue("port", port, "65536"), "port: Value must be at most 65535")
+	assert.NoError(t, ValidateConfigValue("port", port, ""))
+	assert.NoError(t, ValidateConfigValue("mode", mode, "b"))
+	assert.Error(t, ValidateConfigValue("mode", mode, "d"))
+	assert.EqualError(t, ValidateConfigValue("mode", mode, ""), "mode: Value is required")
+	assert.NoError(t, ValidateConfigValue("modes", modes, `["a", "b"]`))
+	assert.Error(t, ValidateConfigValue("modes", modes, `["a", "x"]`))
+	assert.NoError(t, ValidateConfigValue("name", name, "abc"))
+	assert.Error(t, ValidateConfigValue("name", name, "abc1"))
+	assert.NoError(t, ValidateConfigValue("timeout", timeout, "1m"))
+	assert.Error(t, ValidateConfigValue("timeout", timeout, "2m"))
+	assert.NoError(t, ValidateConfigValue("ratio", ratio, "0.5"))
+	assert.EqualError(t, ValidateConfigValue("ratio", ratio, "1.5"), "ratio: Value must be at most 1")
+	assert.EqualError(t, ValidateConfigValue("ratio", ratio, "NaN"), "ratio: Value must be a number")
+	assert.EqualError(t, ValidateConfigValue("ratio", ratio, "-Inf"), "ratio: Value must be a number")
+	secret := SchemaItem{Type: TypePassword}
+	WithPattern("[a-z]+")(&secret)
+	assert.EqualError(t, ValidateConfigValue("secret", secret, "Hunter2"), "secret: Value ****** does not match pattern [a-z]+")
+}
+
+func TestValidateConfigValues(t *testing.T) {
+	schema := map[string]SchemaItem{
+		"port":    {Type: TypeInteger},
+		"enabled": {Type: TypeBoolean},
+		"name":    {Type: TypeString},
+	}
+	assert.Nil(t, ValidateConfigValues(schema, map[string]string{"port": "80", "enabled": "1"}))
+	errs := ValidateConfigValues(schema, map[string]string{"port": "http", "enabled": "yes", "name": "ok", "other": "x"})
+	assert.Len(t, errs, 3)
+	assert.Equal(t, "enabled", errs[0].Field)
+	assert.Equal(t, "other", errs[1].Field)
+	assert.Equal(t, "Unknown configuration key", errs[1].Message)
+	assert.Equal(t, "port", errs[2].Field)
+}
+
+func TestProtectedKeys(t *testing.T) {
+	payments := SchemaItem{}
+	WithProtected()(&payments)
+	schema := map[string]SchemaItem{"limit": {}, "payments": payments}
+	assert.Equal(t, []string{"payments", "payments@host:web-1"}, ProtectedKeys(schema, []string{"payments@host:web-1", "limit", "payments", "unknown"}))
+	assert.Empty(t, ProtectedKeys(schema, []string{"limit"}))
+}
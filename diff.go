@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/slvwolf/ccentral/client"
+)
+
+// parseSource parses a diff source of form [ENV:]SERVICE_ID[@VERSION]
+func parseSource(source string) (string, string, int, error) {
+	env := ""
+	if i := strings.Index(source, ":"); i >= 0 {
+		env, source = source[:i], source[i+1:]
+		if err := client.ValidateEnv(env); err != nil || env == "" {
+			return "", "", 0, client.ErrInvalidVersion
+		}
+	}
+	parts := strings.SplitN(source, "@", 2)
+	if len(parts) == 1 {
+		return env, parts[0], 0, nil
+	}
+	version, err := strconv.Atoi(parts[1])
+	if err != nil || version <= 0 {
+		return "", "", 0, client.ErrInvalidVersion
+	}
+	return env, parts[0], version, nil
+}
+
+// loadSource loads the diff source given in the query parameter, errors are written to the response.
+// Sources without an environment are loaded from the environment of the request.
+func loadSource(w http.ResponseWriter, r *http.Request, a *access, param string) (*client.DiffSource, bool) {
+	value := r.URL.Query().Get(param)
+	env, serviceID, version, err := parseSource(value)
+	if err != nil || serviceID == "" {
+		writeInternalError(w, "Parameter "+param+" must be [ENV:]SERVICE_ID[@VERSION]", http.StatusBadRequest)
+		return nil, false
+	}
+	if !a.allowed(serviceID, "", client.AccessRead) {
+		writeInternalError(w, "Access denied", http.StatusForbidden)
+		return nil, false
+	}
+	sourceAPI := api(r)
+	if env != "" {
+		sourceAPI = cc.Env(env)
+	}
+	source, err := sourceAPI.GetDiffSource(serviceID, version)
+	if err != nil {
+		log.Printf("Problem loading %v for diff: %v", value, err)
+		writeConfigError(w, err)
+		return nil, false
+	}
+	source.Label = sourceAPI.EnvName() + ":" + source.Label
+	return source, true
+}
+
+// handleDiff compares two services or versions given in from and to. With POST the from source is
+// compared against the export document in the body instead.
+func handleDiff(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	from, ok := loadSource(w, r, a, "from")
+	if !ok {
+		return
+	}
+	var to *client.DiffSource
+	switch r.Method {
+	case http.MethodGet:
+		to, ok = loadSource(w, r, a, "to")
+		if !ok {
+			return
+		}
+	case http.MethodPost:
+		export, ok := readExport(w, r)
+		if !ok {
+			return
+		}
+		// The service with the same name is used unless the document contains a single service
+		_, serviceID, _, _ := parseSource(r.URL.Query().Get("from"))
+		for name, data := range export.Services {
+			if len(export.Services) == 1 || name == serviceID {
+				to = api(r).ExportDiffSource("file:"+name, data)
+			}
+		}
+		if to == nil {
+			writeInternalError(w, "Export does not contain "+serviceID, http.StatusBadRequest)
+			return
+		}
+		// Users who can not export the passwords could otherwise test guessed passwords with the document
+		if !a.allowed(serviceID, "*", client.AccessAdmin) {
+			client.OmitPasswords(from, to)
+		}
+	default:
+		writeInternalError(w, "Allowed methods are: GET, POST", http.StatusBadRequest)
+		return
+	}
+	output, err := json.Marshal(client.Diff(from, to))
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/slvwolf/ccentral/client"
+)
+
+// api returns the API of the environment of the request, routes without an environment use the default one
+func api(r *http.Request) client.CCApi {
+	env := mux.Vars(r)["env"]
+	if env == "" {
+		return cc
+	}
+	return cc.Env(env)
+}
+
+// envMiddleware rejects requests to environments with invalid names
+func envMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := client.ValidateEnv(mux.Vars(r)["env"]); err != nil {
+			setHeaders(w)
+			writeInternalError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handleEnvs(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	envs, err := cc.GetEnvironments()
+	if err != nil {
+		log.Printf("Problem getting environments: %v", err)
+		writeInternalError(w, "Could not retrieve environments", http.StatusInternalServerError)
+		return
+	}
+	output, err := json.Marshal(map[string][]string{"envs": envs})
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+// handlePromote copies the keys given in ?keys= (all configured keys when not given) of the service
+// into the environment given in ?to=
+func handlePromote(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	query := r.URL.Query()
+	target := query.Get("to")
+	if err := client.ValidateEnv(target); err != nil || target == "" {
+		writeInternalError(w, "Parameter to must be a valid environment", http.StatusBadRequest)
+		return
+	}
+	var keys []string
+	if query.Get("keys") != "" {
+		keys = strings.Split(query.Get("keys"), ",")
+	}
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	for _, keyID := range keys {
+		if !a.allowed(serviceID, keyID, client.AccessWrite) {
+			writeInternalError(w, "Access denied to "+keyID, http.StatusForbidden)
+			return
+		}
+	}
+	if len(keys) == 0 && !a.allowed(serviceID, "*", client.AccessWrite) {
+		writeInternalError(w, "Access denied", http.StatusForbidden)
+		return
+	}
+	targetSchema, err := cc.Env(target).GetSchema(serviceID)
+	if err != nil {
+		log.Printf("Problem getting schema of %v in %v: %v", serviceID, target, err)
+		writeInternalError(w, "Could not retrieve service schema of the target environment", configErrorStatus(err))
+		return
+	}
+	if !requireAdminForProtected(w, a, serviceID, targetSchema, keys) {
+		return
+	}
+	opts := client.ImportOptions{}
+	opts.DryRun, _ = strconv.ParseBool(query.Get("dry_run"))
+	auditDetail(r, strings.Join(keys, ","), "promote from "+api(r).EnvName()+" to "+target)
+	result, err := api(r).PromoteConfig(serviceID, target, keys, opts, writeOptions(r))
+	if err != nil {
+		writeConfigError(w, err)
+		return
+	}
+	maskChanges(targetSchema, result.Config)
+	output, err := json.Marshal(result)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	if result.Errors != nil {
+		w.WriteHeader(http.StatusBadRequest)
+	} else if !result.DryRun {
+		w.Header().Set("ETag", etagForVersion(result.Version))
+		log.Printf("Configuration promoted: [%v] %d keys from %v to %v by %v (version: %v)", serviceID, len(result.Config), api(r).EnvName(), target, requestActor(r), result.Version)
+	}
+	w.Write(output)
+}
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/ghodss/yaml"
+	"github.com/gorilla/mux"
+	"github.com/slvwolf/ccentral/client"
+)
+
+// wantsYAML tells if the export should be written as YAML instead of JSON
+func wantsYAML(r *http.Request) bool {
+	return r.URL.Query().Get("format") == "yaml" || strings.Contains(r.Header.Get("Accept"), "yaml")
+}
+
+// writeExport writes the export document as JSON or YAML
+func writeExport(w http.ResponseWriter, r *http.Request, export *client.Export) {
+	output, err := json.Marshal(export)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	if wantsYAML(r) {
+		output, err = yaml.JSONToYAML(output)
+		if err != nil {
+			writeInternalError(w, "Could not convert to yaml", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-type", "application/x-yaml")
+	}
+	w.Write(output)
+}
+
+// exportPasswords returns the requested password handling, exporting plain text passwords requires
+// admin access to the service
+func exportPasswords(w http.ResponseWriter, r *http.Request, a *access, serviceID string) (string, bool) {
+	passwords := r.URL.Query().Get("passwords")
+	switch passwords {
+	case "", client.PasswordsExclude:
+		return client.PasswordsExclude, true
+	case client.PasswordsEncrypted:
+		return passwords, true
+	case client.PasswordsInclude:
+		if !a.allowed(serviceID, "*", client.AccessAdmin) {
+			writeInternalError(w, "Access denied", http.StatusForbidden)
+			return "", false
+		}
+		return passwords, true
+	}
+	writeInternalError(w, "Parameter passwords must be exclude, encrypted or include", http.StatusBadRequest)
+	return "", false
+}
+
+// exportServices writes the export of the services, errors are written to the response
+func exportServices(w http.ResponseWriter, r *http.Request, a *access, serviceIDs []string) {
+	export := client.NewExport()
+	for _, serviceID := range serviceIDs {
+		passwords, ok := exportPasswords(w, r, a, serviceID)
+		if !ok {
+			return
+		}
+		service, err := api(r).ExportService(serviceID, passwords)
+		if err != nil {
+			log.Printf("Problem exporting %v: %v", serviceID, err)
+			writeInternalError(w, "Could not export "+serviceID+": "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+		export.Services[serviceID] = *service
+	}
+	writeExport(w, r, export)
+	log.Printf("Exported %d services by %v", len(serviceIDs), requestActor(r))
+}
+
+func handleServiceExport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	exportServices(w, r, a, []string{serviceID})
+}
+
+// handleExport exports every service the user can read
+func handleExport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	serviceList, err := api(r).GetServiceList()
+	if err != nil {
+		writeInternalError(w, "Could not retrieve configuration", http.StatusInternalServerError)
+		return
+	}
+	services := make([]string, 0, len(serviceList.Services))
+	for _, serviceID := range serviceList.Services {
+		if a.allowed(serviceID, "", client.AccessRead) {
+			services = append(services, serviceID)
+		}
+	}
+	exportServices(w, r, a, services)
+}
+
+// readExport parses a JSON or YAML export document from the request body
+func readExport(w http.ResponseWriter, r *http.Request) (*client.Export, bool) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, "Could not read body", http.StatusInternalServerError)
+		return nil, false
+	}
+	// JSON is valid YAML so both formats are accepted
+	body, err = yaml.YAMLToJSON(body)
+	if err != nil {
+		writeInternalError(w, "Could not parse export: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	export := &client.Export{}
+	err = json.Unmarshal(body, export)
+	if err == nil {
+		err = export.Validate()
+	}
+	if err != nil {
+		writeInternalError(w, "Could not parse export: "+err.Error(), http.StatusBadRequest)
+		return nil, false
+	}
+	return export, true
+}
+
+// importResponse lists the results of every service, Error is set when the import was only partially written
+type importResponse struct {
+	Services []*client.ImportResult `json:"services"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+// importServices imports the services of the document. Every service is checked with a dry run
+// before anything is written, so nothing is imported if any of the services is not valid. Services
+// are written one at a time, see writeImport for failed writes.
+func importServices(w http.ResponseWriter, r *http.Request, services map[string]client.ServiceExport) {
+	query := r.URL.Query()
+	opts := client.ImportOptions{}
+	switch query.Get("strategy") {
+	case "", "merge":
+	case "replace":
+		opts.Replace = true
+	default:
+		writeInternalError(w, "Parameter strategy must be merge or replace", http.StatusBadRequest)
+		return
+	}
+	opts.DryRun, _ = strconv.ParseBool(query.Get("dry_run"))
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return
+	}
+	for serviceID := range services {
+		if !a.allowed(serviceID, "*", client.AccessAdmin) {
+			writeInternalError(w, "Access denied to "+serviceID, http.StatusForbidden)
+			return
+		}
+	}
+	auditDetail(r, "", "import of "+strconv.Itoa(len(services))+" services")
+
+	dryRun := client.ImportOptions{Replace: opts.Replace, DryRun: true}
+	results := make([]*client.ImportResult, 0, len(services))
+	valid := true
+	for serviceID, data := range services {
+		result, err := api(r).ImportService(serviceID, data, dryRun, writeOptions(r))
+		if err != nil {
+			writeConfigError(w, err)
+			return
+		}
+		valid = valid && result.Errors == nil
+		results = append(results, result)
+	}
+	status := http.StatusOK
+	if !valid {
+		status = http.StatusBadRequest
+	}
+	response := importResponse{}
+	if valid && !opts.DryRun {
+		results, response.Error, status = writeImport(r, services, opts)
+	}
+	for _, result := range results {
+		schema, err := api(r).GetSchema(result.Service)
+		if err != nil {
+			schema = services[result.Service].Schema
+		}
+		maskChanges(schema, result.Config)
+	}
+	response.Services = results
+	output, err := json.Marshal(response)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(status)
+	w.Write(output)
+}
+
+// writeImport imports the services in order, each in a transaction of its own. Importing stops at the
+// first failure, the results contain the services written so far followed by the failed service.
+// Returns the results, an error describing the partial import and the response status.
+func writeImport(r *http.Request, services map[string]client.ServiceExport, opts client.ImportOptions) ([]*client.ImportResult, string, int) {
+	serviceIDs := make([]string, 0, len(services))
+	for serviceID := range services {
+		serviceIDs = append(serviceIDs, serviceID)
+	}
+	sort.Strings(serviceIDs)
+	results := make([]*client.ImportResult, 0, len(services))
+	for i, serviceID := range serviceIDs {
+		result, err := api(r).ImportService(serviceID, services[serviceID], opts, writeOptions(r))
+		if err != nil {
+			log.Printf("Problem importing %v: %v", serviceID, err)
+			results = append(results, &client.ImportResult{Service: serviceID, Error: err.Error()})
+			message := "Import failed at " + serviceID + ", " + strconv.Itoa(i) + " services before it were imported and " +
+				strconv.Itoa(len(serviceIDs)-i-1) + " services after it were not"
+			return results, message, configErrorStatus(err)
+		}
+		results = append(results, result)
+		log.Printf("Configuration imported: [%v] %d config and %d schema changes by %v (version: %v)", serviceID, len(result.Config), len(result.Schema), requestActor(r), result.Version)
+	}
+	return results, "", http.StatusOK
+}
+
+// handleServiceImport imports a document containing a single service into the service, which allows
+// copying a service under a different name
+func handleServiceImport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	export, ok := readExport(w, r)
+	if !ok {
+		return
+	}
+	if len(export.Services) != 1 {
+		writeInternalError(w, "Export must contain exactly one service", http.StatusBadRequest)
+		return
+	}
+	for _, data := range export.Services {
+		importServices(w, r, map[string]client.ServiceExport{serviceID: data})
+	}
+}
+
+func handleImport(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if r.Method != http.MethodPost {
+		writeInternalError(w, "Allowed methods are: POST", http.StatusBadRequest)
+		return
+	}
+	export, ok := readExport(w, r)
+	if !ok {
+		return
+	}
+	importServices(w, r, export.Services)
+}
@@ -0,0 +1,26 @@
+module github.com/slvwolf/ccentral
+
+go 1.13
+
+require (
+	github.com/coreos/etcd v3.3.27+incompatible
+	github.com/coreos/go-semver v0.3.1
+	github.com/coreos/go-systemd v0.0.0-20191104093116-d3cd4ed1dbcf
+	github.com/coreos/pkg v0.0.0-20180928190104-399ea9e2e55f
+	github.com/ghodss/yaml v1.0.0
+	github.com/gogo/protobuf v1.3.2
+	github.com/golang/protobuf v1.3.5
+	github.com/google/uuid v1.1.1
+	github.com/gorilla/mux v1.8.0
+	github.com/json-iterator/go v1.1.12 // indirect
+	github.com/pkg/errors v0.9.1
+	github.com/stretchr/testify v1.12.1
+	go.uber.org/atomic v1.12.0 // indirect
+	go.uber.org/multierr v1.11.0 // indirect
+	go.uber.org/zap v1.10.0
+	golang.org/x/crypto v0.0.0-20200622213623-75b288015ac9
+	golang.org/x/net v0.0.0-20201021035429-f5854403a974
+	golang.org/x/time v0.0.0-20191024005414-555d28b269f0
+	google.golang.org/grpc v1.26.0
+	gopkg.in/yaml.v2 v2.4.0 // indirect
+)
@@ -46,7 +46,7 @@ func GeneratePrometheusPayload(cc client.CCServerReadApi, unixTime plugins.UnixT
 			log.Printf("WARN Could not retrieve instance list")
 			return nil, err
 		}
-		count := len(instances)
+		count := plugins.CountInstances(instances)
 		counters := make(map[string]int)
 		histograms := make(map[string]*plugins.HistogramPoint)
 
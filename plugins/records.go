@@ -5,6 +5,8 @@ import (
 	"reflect"
 	"regexp"
 	"strings"
+
+	"github.com/slvwolf/ccentral/client"
 )
 
 var valueRe = regexp.MustCompile(`[^a-zA-Z0-9_:]`)
@@ -15,6 +17,9 @@ const MetricPrefixHistogram = "h_"
 // MetricPrefixCounter - Prefix for counter data
 const MetricPrefixCounter = "c_"
 
+// IncludeDeadInstances - Include instances which have stopped reporting in the collected metrics
+var IncludeDeadInstances = false
+
 // UnixTime - Provides unix epoch in seconds
 type UnixTime interface {
 	Unix() int64
@@ -57,8 +62,27 @@ func (p *HistogramPoint) Add(i *HistogramPoint) {
 	p.PercentileMed = (i.PercentileMed + p.PercentileMed) / 2
 }
 
+// counted - Tells if the instance is included in the collected metrics
+func counted(data map[string]interface{}) bool {
+	return IncludeDeadInstances || data[client.InstanceStatusKey] != client.InstanceDead
+}
+
+// CountInstances - Number of instances included in the collected metrics
+func CountInstances(instances map[string]map[string]interface{}) int {
+	count := 0
+	for _, data := range instances {
+		if counted(data) {
+			count++
+		}
+	}
+	return count
+}
+
 // CollectHistograms - Collect all histograms and calculate a single histrogram from all of the instances
 func CollectHistograms(data map[string]interface{}, histograms map[string]*HistogramPoint) map[string]*HistogramPoint {
+	if !counted(data) {
+		return histograms
+	}
 	for key, value := range data {
 		if strings.HasPrefix(key, MetricPrefixHistogram) {
 			cList, found := value.([]interface{})
@@ -83,6 +107,9 @@ func CollectHistograms(data map[string]interface{}, histograms map[string]*Histo
 
 // CollectInstanceCounters - Collects all instance counter data
 func CollectInstanceCounters(data map[string]interface{}, counters map[string]int) map[string]int {
+	if !counted(data) {
+		return counters
+	}
 	for key, value := range data {
 		if strings.HasPrefix(key, MetricPrefixCounter) {
 			cList, found := value.([]interface{})
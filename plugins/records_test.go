@@ -0,0 +1,28 @@
+package plugins
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/slvwolf/ccentral/client"
+)
+
+func TestCollectSkipsDeadInstances(t *testing.T) {
+	data := map[string]interface{}{"c_requests": []interface{}{float64(5)}, client.InstanceStatusKey: client.InstanceDead}
+	assert.Empty(t, CollectInstanceCounters(data, make(map[string]int)))
+	data[client.InstanceStatusKey] = client.InstanceLate
+	assert.Equal(t, 5, CollectInstanceCounters(data, make(map[string]int))["c_requests"])
+	assert.Equal(t, 1, CountInstances(map[string]map[string]interface{}{"a": data, "b": {client.InstanceStatusKey: client.InstanceDead}}))
+}
+
+// Metrics as reported by the client, see TestCounterFormat and TestHistogramFormat of the client
+func TestCollectClientMetrics(t *testing.T) {
+	data := map[string]interface{}{
+		client.CounterPrefix + "calls":     []interface{}{float64(7)},
+		client.HistogramPrefix + "latency": []interface{}{float64(75), float64(95), float64(99), float64(50)},
+	}
+	assert.Equal(t, map[string]int{"c_calls": 7}, CollectInstanceCounters(data, make(map[string]int)))
+	histograms := CollectHistograms(data, make(map[string]*HistogramPoint))
+	assert.Equal(t, &HistogramPoint{Key: "h_latency", Percentile75: 75, Percentile95: 95, Percentile99: 99, PercentileMed: 50}, histograms["h_latency"])
+}
@@ -148,7 +148,7 @@ func pollLoop(service *client.CCentralService, cc client.CCServerReadApi) {
 				log.Printf("Handling service %v", serviceID)
 				instances, err := cc.GetInstanceList(serviceID)
 				if err == nil {
-					count := len(instances)
+					count := plugins.CountInstances(instances)
 					counters := make(map[string]int)
 					key := fmt.Sprintf("%s.%s", serviceID, "instances")
 					metric := newMetric("ccentral", key, strconv.Itoa(count))
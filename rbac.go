@@ -0,0 +1,118 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"github.com/slvwolf/ccentral/client"
+)
+
+// access is the view of the RBAC policy for the user making the request
+type access struct {
+	user   string
+	policy *client.Policy
+}
+
+// requestAccess loads the RBAC policy for the authenticated user of the request, everything is allowed
+// when no policy has been stored. The policy is not enforced without authentication as the actor header
+// can be set by anyone.
+func requestAccess(r *http.Request) (*access, error) {
+	if !auth.enabled() {
+		return &access{}, nil
+	}
+	policy, err := cc.GetPolicy()
+	if err != nil {
+		return nil, err
+	}
+	user, ok := authenticatedUser(r)
+	if !ok {
+		user = "anonymous"
+	}
+	return &access{user: user, policy: policy}, nil
+}
+
+// level returns the access level of the user to the key, overrides share the access of the key they override
+func (a *access) level(serviceID string, keyID string) int {
+	if a.policy == nil {
+		return client.AccessAdmin
+	}
+	return a.policy.Access(a.user, serviceID, client.BaseKey(keyID))
+}
+
+func (a *access) allowed(serviceID string, keyID string, level int) bool {
+	return a.level(serviceID, keyID) >= level
+}
+
+// authorize checks that the user has the access level to the service (and key when given) and writes
+// an error response when not
+func authorize(w http.ResponseWriter, r *http.Request, serviceID string, keyID string, level int) (*access, bool) {
+	a, err := requestAccess(r)
+	if err != nil {
+		log.Printf("Problem loading RBAC policy: %v", err)
+		writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+		return nil, false
+	}
+	if !a.allowed(serviceID, keyID, level) {
+		writeInternalError(w, "Access denied", http.StatusForbidden)
+		return nil, false
+	}
+	return a, true
+}
+
+// handlePolicy returns or replaces the RBAC policy, requires authentication and admin access to all
+// keys of all services. Any authenticated user may store the first policy.
+func handlePolicy(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	if !auth.enabled() {
+		writeInternalError(w, "Access policy requires authentication to be enabled", http.StatusForbidden)
+		return
+	}
+	_, ok := authorize(w, r, "*", "*", client.AccessAdmin)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		policy, err := cc.GetPolicy()
+		if err != nil {
+			writeInternalError(w, "Could not retrieve access policy", http.StatusInternalServerError)
+			return
+		}
+		if policy == nil {
+			policy = &client.Policy{}
+		}
+		output, err := json.Marshal(policy)
+		if err != nil {
+			writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+			return
+		}
+		w.Write(output)
+	case http.MethodPut:
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			writeInternalError(w, "Could not read body", http.StatusInternalServerError)
+			return
+		}
+		policy := &client.Policy{}
+		err = json.Unmarshal(body, policy)
+		if err != nil {
+			writeInternalError(w, "Could not parse policy: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = policy.Validate()
+		if err != nil {
+			writeInternalError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = cc.SetPolicy(policy)
+		if err != nil {
+			writeInternalError(w, "Could not store access policy", http.StatusInternalServerError)
+			return
+		}
+		log.Printf("Access policy updated by %v", requestActor(r))
+	default:
+		writeInternalError(w, "Allowed methods are: GET, PUT", http.StatusBadRequest)
+	}
+}
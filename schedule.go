@@ -0,0 +1,257 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+	"github.com/slvwolf/ccentral/client"
+)
+
+// scheduleRequest is the body of a new scheduled change, apply_at is epoch seconds or RFC3339 and
+// revert_after seconds or a duration such as 2h
+type scheduleRequest struct {
+	Values      map[string]string `json:"values"`
+	ApplyAt     string            `json:"apply_at"`
+	RevertAfter string            `json:"revert_after"`
+}
+
+// times returns the time the change is applied at and the duration after which it is reverted, 0 when
+// the change is not reverted
+func (s scheduleRequest) times() (time.Time, time.Duration, error) {
+	applyAt, err := parseTime(s.ApplyAt)
+	if err != nil || applyAt.IsZero() {
+		return time.Time{}, 0, errors.New("Field apply_at must be epoch seconds or RFC3339")
+	}
+	if s.RevertAfter == "" {
+		return applyAt, 0, nil
+	}
+	revertAfter, err := client.ParseDuration(s.RevertAfter)
+	if err != nil || revertAfter < time.Second {
+		return time.Time{}, 0, errors.New("Field revert_after must be at least one second")
+	}
+	return applyAt, revertAfter, nil
+}
+
+type scheduleResponse struct {
+	Changes []client.ScheduledChange `json:"changes"`
+}
+
+// handleSchedule lists the scheduled changes of the service or schedules a new change
+func handleSchedule(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	serviceID := mux.Vars(r)["serviceId"]
+	switch r.Method {
+	case http.MethodGet:
+		listScheduledChanges(w, r, serviceID)
+	case http.MethodPost:
+		scheduleChange(w, r, serviceID)
+	default:
+		writeInternalError(w, "Allowed methods are: GET, POST", http.StatusBadRequest)
+	}
+}
+
+func listScheduledChanges(w http.ResponseWriter, r *http.Request, serviceID string) {
+	if _, ok := authorize(w, r, serviceID, "", client.AccessRead); !ok {
+		return
+	}
+	changes, err := api(r).GetScheduledChanges(serviceID)
+	if err != nil {
+		log.Printf("Problem getting scheduled changes: %v", err)
+		writeInternalError(w, "Could not retrieve scheduled changes", http.StatusInternalServerError)
+		return
+	}
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	for i := range changes {
+		maskScheduledChange(schema, &changes[i])
+	}
+	output, err := json.Marshal(scheduleResponse{Changes: changes})
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+}
+
+func scheduleChange(w http.ResponseWriter, r *http.Request, serviceID string) {
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		writeInternalError(w, "Could not read body", http.StatusInternalServerError)
+		return
+	}
+	request := scheduleRequest{}
+	err = json.Unmarshal(body, &request)
+	if err != nil {
+		writeInternalError(w, `Body must be a JSON object such as {"values": {"KEY": "VALUE"}, "apply_at": "2006-01-02T03:00:00Z", "revert_after": "2h"}`, http.StatusBadRequest)
+		return
+	}
+	if len(request.Values) == 0 {
+		writeInternalError(w, "No values given", http.StatusBadRequest)
+		return
+	}
+	applyAt, revertAfter, err := request.times()
+	if err != nil {
+		writeInternalError(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	for keyID := range request.Values {
+		if !a.allowed(serviceID, keyID, client.AccessWrite) {
+			writeInternalError(w, "Access denied to "+keyID, http.StatusForbidden)
+			return
+		}
+	}
+
+	schema, err := api(r).GetSchema(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve service schema", http.StatusInternalServerError)
+		return
+	}
+	config, err := api(r).GetConfig(serviceID)
+	if err != nil {
+		writeInternalError(w, "Could not retrieve config", http.StatusInternalServerError)
+		return
+	}
+	auditChanges(r, schema, config, request.Values)
+	if errs := client.ValidateConfigValues(schema, request.Values); errs != nil {
+		writeValidationErrors(w, errs)
+		return
+	}
+	keys := make([]string, 0, len(request.Values))
+	for keyID := range request.Values {
+		keys = append(keys, keyID)
+	}
+	if !requireAdminForProtected(w, a, serviceID, schema, keys) {
+		return
+	}
+
+	change, err := api(r).ScheduleChange(serviceID, client.ScheduledChange{
+		Values:      request.Values,
+		ApplyAt:     applyAt.Unix(),
+		RevertAfter: int64(revertAfter / time.Second),
+		Actor:       requestActor(r),
+	})
+	if err != nil {
+		writeInternalError(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	maskScheduledChange(schema, change)
+	output, err := json.Marshal(change)
+	if err != nil {
+		writeInternalError(w, "Could not convert to json", http.StatusInternalServerError)
+		return
+	}
+	w.Write(output)
+	log.Printf("Configuration change scheduled: [%v] %v at %v by %v (id: %v)", serviceID, strings.Join(scheduledKeys(change), ", "), applyAt.Format(time.RFC3339), requestActor(r), change.ID)
+}
+
+// handleScheduledChange cancels a scheduled change, requires write access to every key of the change
+func handleScheduledChange(w http.ResponseWriter, r *http.Request) {
+	setHeaders(w)
+	vars := mux.Vars(r)
+	serviceID, changeID := vars["serviceId"], vars["changeId"]
+	if r.Method != http.MethodDelete {
+		writeInternalError(w, "Allowed methods are: DELETE", http.StatusBadRequest)
+		return
+	}
+	a, ok := authorize(w, r, serviceID, "", client.AccessRead)
+	if !ok {
+		return
+	}
+	changes, err := api(r).GetScheduledChanges(serviceID)
+	if err != nil {
+		log.Printf("Problem getting scheduled changes: %v", err)
+		writeInternalError(w, "Could not retrieve scheduled changes", http.StatusInternalServerError)
+		return
+	}
+	for _, change := range changes {
+		if change.ID != changeID {
+			continue
+		}
+		for keyID := range change.Values {
+			if !a.allowed(serviceID, keyID, client.AccessWrite) {
+				writeInternalError(w, "Access denied to "+keyID, http.StatusForbidden)
+				return
+			}
+		}
+		auditDetail(r, strings.Join(scheduledKeys(&change), ","), "scheduled change "+change.ID)
+		_, err = api(r).CancelScheduledChange(serviceID, changeID)
+		if err != nil {
+			writeInternalError(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		w.Write([]byte("{\"id\": \"" + changeID + "\"}"))
+		log.Printf("Scheduled change cancelled: [%v] %v by %v", serviceID, changeID, requestActor(r))
+		return
+	}
+	writeInternalError(w, "Scheduled change not found", http.StatusNotFound)
+}
+
+// scheduledKeys returns the keys of the change in order
+func scheduledKeys(change *client.ScheduledChange) []string {
+	keys := make([]string, 0, len(change.Values))
+	for keyID := range change.Values {
+		keys = append(keys, keyID)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// maskScheduledChange hides the values of password fields in the change
+func maskScheduledChange(schema map[string]client.SchemaItem, change *client.ScheduledChange) {
+	for keyID, value := range change.Values {
+		change.Values[keyID] = maskValue(schema, keyID, value)
+	}
+	for keyID, value := range change.Previous {
+		change.Previous[keyID] = maskValue(schema, keyID, value)
+	}
+}
+
+// notifyScheduledChange logs and audits a change applied, reverted or failed by the scheduler
+func notifyScheduledChange(change client.ScheduledChange) {
+	schema, err := cc.Env(change.Env).GetSchema(change.Service)
+	if err == nil {
+		maskScheduledChange(schema, &change)
+	}
+	oldValues, newValues := change.Previous, change.Values
+	action := "scheduled"
+	if change.Status == client.ScheduleReverted {
+		action = "scheduled-revert"
+		oldValues, newValues = newValues, oldValues
+	}
+	oldData, _ := json.Marshal(oldValues)
+	newData, _ := json.Marshal(newValues)
+	record := client.AuditRecord{
+		Timestamp: time.Now().Unix(),
+		Actor:     change.Actor,
+		Action:    action,
+		Env:       change.Env,
+		Service:   change.Service,
+		Key:       strings.Join(scheduledKeys(&change), ","),
+		OldValue:  string(oldData),
+		NewValue:  string(newData),
+		Status:    http.StatusOK,
+		Result:    "success",
+	}
+	if change.Status == client.ScheduleFailed {
+		record.Status = http.StatusBadRequest
+		record.Result = "failure"
+		log.Printf("Scheduled change failed: [%v] %v (id: %v): %v", change.Service, record.Key, change.ID, change.Error)
+	} else {
+		log.Printf("Scheduled change %v: [%v] %v (id: %v, version: %v)", change.Status, change.Service, record.Key, change.ID, change.Version)
+	}
+	writeAudit(record)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseTime(t *testing.T) {
+	parsed, err := parseTime("1500000000")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000), parsed.Unix())
+	parsed, err = parseTime("2017-07-14T02:40:00Z")
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000), parsed.Unix())
+	parsed, err = parseTime("")
+	assert.NoError(t, err)
+	assert.True(t, parsed.IsZero())
+	_, err = parseTime("tomorrow")
+	assert.Error(t, err)
+}
+
+func TestScheduleRequestTimes(t *testing.T) {
+	applyAt, revertAfter, err := scheduleRequest{ApplyAt: "1500000000", RevertAfter: "2h"}.times()
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1500000000), applyAt.Unix())
+	assert.Equal(t, 2*time.Hour, revertAfter)
+
+	_, revertAfter, err = scheduleRequest{ApplyAt: "1500000000", RevertAfter: "90"}.times()
+	assert.NoError(t, err)
+	assert.Equal(t, 90*time.Second, revertAfter)
+
+	_, revertAfter, err = scheduleRequest{ApplyAt: "1500000000"}.times()
+	assert.NoError(t, err)
+	assert.Equal(t, time.Duration(0), revertAfter)
+
+	for _, request := range []scheduleRequest{
+		{},
+		{ApplyAt: "soon"},
+		{ApplyAt: "1500000000", RevertAfter: "500ms"},
+		{ApplyAt: "1500000000", RevertAfter: "-1"},
+		{ApplyAt: "1500000000", RevertAfter: "later"},
+	} {
+		_, _, err = request.times()
+		assert.Error(t, err, request)
+	}
+}
@@ -10,9 +10,34 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
         $scope.instanceHeaders = {};
         $scope.info = [];
         $scope.loading = false;
+        $scope.etag = null;
+        $scope.diff = {from: "", to: "", result: null, error: null};
+        $scope.envs = ["default"];
+        $scope.env = "default";
+
+        // All service requests are made in the selected environment
+        $scope.base = function() {
+            return '/api/1/envs/' + $scope.env;
+        };
+
+        $scope.loadEnvs = function() {
+            $http.get('/api/1/envs').then(function(v) {
+                $scope.envs = v.data.envs;
+            });
+        };
+
+        $scope.selectEnv = function(env) {
+            $scope.env = env;
+            $scope.promoteTarget = null;
+            $scope.selectedService = "";
+            $scope.serviceData = null;
+            $scope.etag = null;
+            $scope.services = [];
+            $scope.loadServices();
+        };
 
         $scope.loadServices = function() {
-            $http.get('/api/1/services').then(function(v) {
+            $http.get($scope.base() + '/services').then(function(v) {
                 console.log(v);
                 $scope.services = v.data.services;
             });
@@ -23,7 +48,7 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
                 return;
             }
             $scope.loading = true;
-            $http.get('/api/1/services/' + $scope.selectedService).then(function(v) {
+            $http.get($scope.base() + '/services/' + $scope.selectedService).then(function(v) {
                 if ($scope.serviceData === null) {
                     $scope.serviceData = {
                         "v": {
@@ -37,20 +62,44 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
                 _.each(v.data.schema, function(v, k) {
                     if ($scope.serviceData[k] === undefined) {
                         $scope.serviceData[k] = v;
-                        v.value = v.default;
-                        v.value_orig = v.default;
+                        v.numeric = v.type === "integer" || v.type === "float";
+                        v.value = $scope.fromStored(v, v.default);
+                        v.value_orig = v.value;
                         v.config_set = false;
                     }
                 });
-                _.each(v.data.config, function(v, k) {
-                    if ($scope.serviceData[k] !== undefined && !$scope.serviceData[k].config_set) {
-                        $scope.serviceData[k].value_orig = v.value;
-                        $scope.serviceData[k].value = v.value;
-                        $scope.serviceData[k].config_set = true;
-                    }
+                // Keys the user is not allowed to change are shown read-only
+                var writable = v.data.writable;
+                _.each($scope.serviceData, function(field, k) {
+                    field.readonly = writable === undefined ? false : !writable[k];
                 });
+                // Values and the ETag are reloaded together only while nothing is being edited so that
+                // edits made on values which have changed since are rejected by the server
+                if ($scope.changedKeys().length === 0) {
+                    var config = v.data.config || {};
+                    $scope.etag = v.headers('ETag');
+                    _.each($scope.serviceData, function(field, k) {
+                        field.config_set = config[k] !== undefined;
+                        field.value = $scope.fromStored(field, field.config_set ? config[k].value : field.default);
+                        field.value_orig = field.value;
+                    });
+                }
+                $scope.loadApprovals();
                 $scope.instances = v.data.clients;
                 $scope.instanceTotals = {};
+                $scope.flags = v.data.flags || {};
+                // Instances using an overridden value are listed under the field
+                $scope.overrides = {};
+                _.each(v.data.effective, function(values, clientId) {
+                    _.each(values, function(effective, k) {
+                        if (effective.source !== "service" && effective.source !== "default") {
+                            if ($scope.overrides[k] === undefined) {
+                                $scope.overrides[k] = [];
+                            }
+                            $scope.overrides[k].push({"instance": clientId, "value": effective.value, "source": effective.source});
+                        }
+                    });
+                });
 
                 _.each($scope.instances, function(serviceData, serviceId) {
                     $scope.instanceTags[serviceId] = [];
@@ -61,7 +110,8 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
                             if ($scope.instanceTotals[nkey] === undefined) {
                                 $scope.instanceTotals[nkey] = 0;
                             }
-                            if (value !== undefined && value.length > 0) {
+                            // Instances which have stopped reporting are left out of the totals
+                            if (value !== undefined && value.length > 0 && serviceData.status !== "dead") {
                                 $scope.instanceTotals[nkey] += parseInt(value[value.length - 1]);
                             }
                         }
@@ -69,8 +119,12 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
                             nkey = key.substr(2);
                         }
                         if (key === "ts") {
-                            if (value < (new Date()).getTime() / 1000 - 60) {
-                                $scope.instanceTags[serviceId].push({"text": "Expired timestamp", "type": "warning"});
+                            return;
+                        } else if (key === "status") {
+                            if (value === "late") {
+                                $scope.instanceTags[serviceId].push({"text": "Late", "type": "warning"});
+                            } else if (value === "dead") {
+                                $scope.instanceTags[serviceId].push({"text": "Dead", "type": "danger"});
                             }
                         } else if (key === "v") {
                             if (value != $scope.serviceData.v.value) {
@@ -88,16 +142,54 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
             });
         }
 
+        // Pending change requests of protected keys, keys waiting for approval are marked in the form
+        $scope.loadApprovals = function() {
+            $http.get($scope.base() + '/services/' + $scope.selectedService + '/approvals').then(function(v) {
+                $scope.approvals = v.data.requests;
+                $scope.pending = {};
+                _.each($scope.approvals, function(request) {
+                    _.each(request.values, function(value, key) {
+                        $scope.pending[key] = true;
+                    });
+                });
+            });
+        };
+
+        $scope.review = function(request, action) {
+            var url = $scope.base() + '/services/' + $scope.selectedService + '/approvals/' + request.id + '/' + action;
+            $http.post(url).then(function(v) {
+                $scope.selectService($scope.selectedService);
+            }, function(v) {
+                alert("Could not " + action + " the change: " + v.data.error);
+            });
+        };
+
         $scope.selectService = function(service) {
             $scope.selectedService = service;
             $scope.serviceData = null;
+            $scope.etag = null;
             $scope.instances = [];
             $scope.instanceHeaders = {};
             $scope.instanceTags = {};
+            $scope.overrides = {};
+            $scope.flags = {};
+            $scope.approvals = [];
+            $scope.pending = {};
             $scope.info = [];
+            $scope.diff = {from: service, to: "", result: null, error: null};
             $scope.refreshService();
         };
 
+        $scope.compare = function() {
+            $scope.diff.error = null;
+            $http.get($scope.base() + '/diff', {params: {from: $scope.diff.from, to: $scope.diff.to}}).then(function(v) {
+                $scope.diff.result = v.data;
+            }, function(v) {
+                $scope.diff.result = null;
+                $scope.diff.error = v.data.error;
+            });
+        };
+
         $scope.representValue = function(key, value) {
             if (key.startsWith("c_")) {
                 if (value === undefined || value.length === 0) {
@@ -118,17 +210,136 @@ m.controller('MainCtrl', ['$scope', '$http', '$interval',
             return value;
         };
 
-        $scope.saveField = function(key) {
-            data = $scope.serviceData[key].value;
-            console.log("Saving " + key + " = " + data);
-            $http.put('/api/1/services/' + $scope.selectedService + "/keys/" + key, data).then(function(v) {
-                $scope.serviceData[key].value_orig = $scope.serviceData[key].value;
+        // Instances which have stopped reporting are not counted, like in the flag counts of the server
+        $scope.instanceCount = function() {
+            return _.filter(_.values($scope.instances || {}), function(instance) {
+                return instance.status !== "dead";
+            }).length;
+        };
+
+        // Numeric fields are edited as numbers, everything is stored as strings
+        $scope.fromStored = function(field, value) {
+            if (field.numeric && value !== "" && !isNaN(Number(value))) {
+                return Number(value);
+            }
+            return value;
+        };
+
+        $scope.isChanged = function(field) {
+            return !field.readonly && field.value != field.value_orig && field.value !== null && field.value !== undefined;
+        };
+
+        $scope.changedKeys = function() {
+            return _.filter(_.keys($scope.serviceData || {}), function(key) {
+                return $scope.isChanged($scope.serviceData[key]);
+            });
+        };
+
+        $scope.discardChanges = function() {
+            _.each($scope.serviceData, function(field) {
+                field.value = field.value_orig;
+            });
+        };
+
+        // All edited fields are written at once so that instances never see a half-applied configuration
+        $scope.applyChanges = function() {
+            var keys = $scope.changedKeys();
+            var data = {};
+            _.each(keys, function(key) {
+                data[key] = String($scope.serviceData[key].value);
+            });
+            var config = {headers: {}};
+            if ($scope.etag !== null) {
+                config.headers['If-Match'] = $scope.etag;
+            }
+            $http({method: 'PATCH', url: $scope.base() + '/services/' + $scope.selectedService + "/config", data: data, headers: config.headers}).then(function(v) {
+                if (v.status === 202) {
+                    alert("Some of the keys are protected, the changes are waiting for the approval of another user");
+                    $scope.discardChanges();
+                    $scope.loadApprovals();
+                    return;
+                }
+                _.each(keys, function(key) {
+                    var field = $scope.serviceData[key];
+                    field.value_orig = field.value;
+                    field.config_set = true;
+                });
+                $scope.etag = v.headers('ETag');
+            }, function(v) {
+                if (v.status === 412) {
+                    if (confirm("Someone else changed this configuration after you loaded it. Reload the latest values? Your unsaved changes will be lost.")) {
+                        $scope.selectService($scope.selectedService);
+                    }
+                } else if (v.status === 403) {
+                    alert("You are not allowed to change some of the keys: " + v.data.error);
+                } else if (v.status === 400) {
+                    var messages = _.map(v.data.errors || [v.data], function(e) {
+                        return (e.field ? e.field + ": " : "") + e.error;
+                    });
+                    alert("Invalid values:\n" + messages.join("\n"));
+                }
+            });
+        };
+
+        $scope.resetField = function(key) {
+            if (!confirm("Revert '" + key + "' to the default value?")) {
+                return;
+            }
+            var config = {headers: {}};
+            if ($scope.etag !== null) {
+                config.headers['If-Match'] = $scope.etag;
+            }
+            $http.delete($scope.base() + '/services/' + $scope.selectedService + "/keys/" + key, config).then(function(v) {
+                if (v.status === 202) {
+                    alert("'" + key + "' is protected, the change is waiting for the approval of another user");
+                    $scope.loadApprovals();
+                    return;
+                }
+                var field = $scope.serviceData[key];
+                field.value = $scope.fromStored(field, field.default);
+                field.value_orig = field.value;
+                field.config_set = false;
+                $scope.etag = v.headers('ETag');
+            }, function(v) {
+                if (v.status === 412) {
+                    if (confirm("Someone else changed this configuration after you loaded it. Reload the latest values?")) {
+                        $scope.selectService($scope.selectedService);
+                    }
+                } else if (v.status === 403) {
+                    alert("You are not allowed to change '" + key + "'");
+                }
             });
         };
 
         $scope.configChanged = function(config) {
             $scope.serviceData.config[config].newValue = config;
         };
+        // Configured values are copied after the changes of a dry run have been confirmed
+        $scope.promote = function(target) {
+            var url = $scope.base() + '/services/' + $scope.selectedService + '/promote';
+            $http.post(url, null, {params: {to: target, dry_run: true}}).then(function(v) {
+                if (v.data.config.length === 0) {
+                    alert("Configuration of '" + target + "' is already up to date");
+                    return;
+                }
+                var changes = _.map(v.data.config, function(c) {
+                    return c.key + ": " + (c.old || "(not set)") + " -> " + c.new;
+                });
+                if (!confirm("Promote to '" + target + "'?\n" + changes.join("\n"))) {
+                    return;
+                }
+                $http.post(url, null, {params: {to: target}}).then(function(v) {
+                    alert("Promoted " + v.data.config.length + " keys to '" + target + "' (version " + v.data.version + ")");
+                });
+            }, function(v) {
+                var messages = _.map(v.data.errors || [v.data], function(e) {
+                    return (e.field ? e.field + ": " : "") + e.error;
+                });
+                alert("Could not promote to '" + target + "':\n" + messages.join("\n"));
+            });
+        };
+
+        $scope.loadEnvs();
         $scope.loadServices();
         $interval($scope.refreshService, 2000);
     }